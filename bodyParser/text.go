@@ -69,6 +69,8 @@ func GetString(obj interface{}) string {
 		return strconv.FormatInt(int64(v), 10)
 	case string:
 		return v
+	case []byte:
+		return string(v)
 	default:
 		return ""
 	}
@@ -0,0 +1,181 @@
+package isuperagent
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+type BulkheadConfig struct {
+	// The key of bulkheads, default is KeyByHost, every key has its own limit
+	Key KeyFunc
+	// The max requests in flight
+	MaxConcurrent int
+	// The max requests waiting for the slot, the request is rejected if the queue is full, 0 is no queue
+	MaxQueue int
+	// The max time to wait in queue, 0 is waiting until the context is done
+	QueueTimeout time.Duration
+	// Called after the metrics of key are changed
+	OnMetrics func(metrics BulkheadMetrics)
+}
+
+// The metrics of bulkhead of key.
+type BulkheadMetrics struct {
+	Key string
+	// The requests in flight
+	InFlight int
+	// The requests waiting in queue, and the max of it
+	Queued    int
+	MaxQueued int
+	// The requests rejected because the queue is full, and waited in queue too long
+	Rejected int64
+	TimedOut int64
+}
+
+type bulkheadPartition struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	metrics BulkheadMetrics
+}
+
+type bulkhead struct {
+	config BulkheadConfig
+
+	mu         sync.Mutex
+	partitions map[string]*bulkheadPartition
+}
+
+// Middleware: concurrency limiting, which is known as bulkhead
+//
+// Limit the requests in flight of every key to MaxConcurrent, the other requests wait in the queue of MaxQueue,
+// they are rejected with *error.BulkheadError if the queue is full or they wait longer than QueueTimeout,
+// so a slow server cannot exhaust the goroutines.
+// The middleware is created by a *BulkheadConfig, such as:
+//
+//	isuperagent.NewMiddleware("bulkhead", &isuperagent.BulkheadConfig{MaxConcurrent: 10, MaxQueue: 100, QueueTimeout: time.Second})
+func NewBulkheadMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.BulkheadConfig")
+	}
+
+	var config BulkheadConfig
+	switch c := v[0].(type) {
+	case *BulkheadConfig:
+		config = *c
+	case BulkheadConfig:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.BulkheadConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.MaxConcurrent <= 0 {
+		return nil, errors.New(fmt.Sprintf("excepted max concurrent is greater than 0, but got %d", config.MaxConcurrent))
+	}
+	if config.MaxQueue < 0 {
+		config.MaxQueue = 0
+	}
+	if config.Key == nil {
+		config.Key = KeyByHost
+	}
+
+	b := &bulkhead{config: config, partitions: map[string]*bulkheadPartition{}}
+
+	return func(ctx Context, next Next) error {
+		key := config.Key(ctx.GetReq())
+		if key == "" {
+			return next()
+		}
+		p := b.partition(key)
+
+		if err := b.acquire(ctx.GetReq(), key, p); err != nil {
+			return err
+		}
+		defer b.release(p)
+
+		return next()
+	}, nil
+}
+
+func (b *bulkhead) partition(key string) *bulkheadPartition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.partitions[key]
+	if !ok {
+		p = &bulkheadPartition{slots: make(chan struct{}, b.config.MaxConcurrent), metrics: BulkheadMetrics{Key: key}}
+		b.partitions[key] = p
+	}
+
+	return p
+}
+
+// Take a slot, or wait for it in queue.
+func (b *bulkhead) acquire(r Request, key string, p *bulkheadPartition) error {
+	select {
+	case p.slots <- struct{}{}:
+		b.update(p, func(m *BulkheadMetrics) { m.InFlight++ })
+		return nil
+	default:
+	}
+
+	p.mu.Lock()
+	if p.metrics.Queued >= b.config.MaxQueue {
+		p.metrics.Rejected++
+		metrics := p.metrics
+		p.mu.Unlock()
+		b.notify(metrics)
+		return &ierror.BulkheadError{Key: key, Reason: ierror.BulkheadQueueFull}
+	}
+	p.metrics.Queued++
+	if p.metrics.Queued > p.metrics.MaxQueued {
+		p.metrics.MaxQueued = p.metrics.Queued
+	}
+	metrics := p.metrics
+	p.mu.Unlock()
+	b.notify(metrics)
+
+	var timeout <-chan time.Time
+	if b.config.QueueTimeout > 0 {
+		timer := time.NewTimer(b.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		b.update(p, func(m *BulkheadMetrics) { m.Queued--; m.InFlight++ })
+		return nil
+	case <-timeout:
+		b.update(p, func(m *BulkheadMetrics) { m.Queued--; m.TimedOut++ })
+		return &ierror.BulkheadError{Key: key, Reason: ierror.BulkheadQueueTimeout}
+	case <-r.GetContext().Done():
+		b.update(p, func(m *BulkheadMetrics) { m.Queued-- })
+		return r.GetContext().Err()
+	}
+}
+
+func (b *bulkhead) release(p *bulkheadPartition) {
+	<-p.slots
+	b.update(p, func(m *BulkheadMetrics) { m.InFlight-- })
+}
+
+// Change the metrics of partition and notify them.
+func (b *bulkhead) update(p *bulkheadPartition, f func(m *BulkheadMetrics)) {
+	p.mu.Lock()
+	f(&p.metrics)
+	metrics := p.metrics
+	p.mu.Unlock()
+
+	b.notify(metrics)
+}
+
+func (b *bulkhead) notify(metrics BulkheadMetrics) {
+	if b.config.OnMetrics != nil {
+		b.config.OnMetrics(metrics)
+	}
+}
@@ -0,0 +1,637 @@
+package isuperagent
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default capacity of in-memory cache store
+const DefaultCacheCapacity = 1000
+
+// The max variants of one url, the oldest variant is dropped if there are more
+const maxCacheVariants = 8
+
+// CacheStore stores the cached responses of cache middleware.
+// The data is the encoded responses, the store needs not to know the format.
+type CacheStore interface {
+	Get(key string) (data []byte, ok bool, err error)
+	Set(key string, data []byte) error
+	Delete(key string) error
+}
+
+// The status codes cacheable by default, see RFC 7231 section 6.1
+var cacheableStatusCodes = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// The cached response.
+type cacheEntry struct {
+	StatusCode   int         `json:"status_code"`
+	Status       string      `json:"status"`
+	Proto        string      `json:"proto"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	// The request headers named by the Vary header
+	Vary map[string]string `json:"vary"`
+}
+
+type cache struct {
+	store CacheStore
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+type cacheRevalidateKey struct{}
+
+// Middleware: HTTP caching, see RFC 7234
+//
+// The GET responses are cached by the Cache-Control, Expires and heuristic freshness of Last-Modified,
+// and the variants of Vary header are cached separately.
+// The stale response is revalidated by If-None-Match and If-Modified-Since,
+// it is served while revalidating in background within stale-while-revalidate,
+// and served if the server fails within stale-if-error.
+// The cached responses of url are invalidated after it is changed by POST, PUT, PATCH or DELETE.
+//
+// The first argument is the optional isuperagent.CacheStore, default is an in-memory LRU store of DefaultCacheCapacity,
+// use Response.IsFromCache to tell whether the response is served from cache.
+func NewCacheMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	c := &cache{revalidating: map[string]bool{}}
+
+	if len(v) > 0 && v[0] != nil {
+		if store, ok := v[0].(CacheStore); ok {
+			c.store = store
+		} else {
+			return nil, errors.New(fmt.Sprintf("excepted first argument is isuperagent.CacheStore, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+		}
+	} else {
+		c.store = NewLruCacheStore(DefaultCacheCapacity)
+	}
+
+	return c.middleware, nil
+}
+
+func (c *cache) middleware(ctx Context, next Next) error {
+	r := ctx.GetReq()
+	key := http.MethodGet + " " + cacheUrl(r)
+
+	switch r.GetMethod() {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		// the unsafe method changes the resource, see RFC 7234 section 4.4
+		if err := next(); err != nil {
+			return err
+		}
+		if res := ctx.GetRes(); res != nil && res.GetStatusCode() < 400 {
+			_ = c.store.Delete(key)
+		}
+		return nil
+	default:
+		return next()
+	}
+
+	reqCC := parseCacheControl(r.GetHeaders())
+	if _, ok := reqCC["no-store"]; ok {
+		return next()
+	}
+	if len(r.GetHeaders()["Cache-Control"]) == 0 && strings.Contains(strings.ToLower(r.GetHeader("Pragma")), "no-cache") {
+		reqCC["no-cache"] = ""
+	}
+	_, onlyIfCached := reqCC["only-if-cached"]
+	revalidating := r.GetContext().Value(cacheRevalidateKey{}) != nil
+
+	entries := c.load(key)
+	entry := matchCacheEntry(entries, r.GetHeaders())
+	now := time.Now()
+
+	if entry == nil {
+		if onlyIfCached {
+			ctx.SetRes(newGatewayTimeoutResponse())
+			return nil
+		}
+
+		requestTime := time.Now()
+		if err := next(); err != nil {
+			return err
+		}
+		c.save(key, entries, r, ctx.GetRes(), requestTime)
+
+		return nil
+	}
+
+	respCC := parseCacheControl(entry.Header)
+	age := entry.age(now)
+	lifetime := entry.freshnessLifetime(respCC)
+	_, reqNoCache := reqCC["no-cache"]
+	_, respNoCache := respCC["no-cache"]
+	_, mustRevalidate := respCC["must-revalidate"]
+
+	if !revalidating && !reqNoCache && !respNoCache {
+		if isCacheFresh(age, lifetime, reqCC, mustRevalidate) {
+			ctx.SetRes(entry.response(age))
+			return nil
+		}
+
+		if swr, ok := cacheSeconds(respCC, "stale-while-revalidate"); ok && !mustRevalidate && age < lifetime+swr {
+			ctx.SetRes(entry.response(age))
+			c.revalidate(key, r)
+			return nil
+		}
+	}
+
+	if onlyIfCached {
+		ctx.SetRes(newGatewayTimeoutResponse())
+		return nil
+	}
+
+	// revalidate the stale response by the conditional request
+	conditions := map[string]string{}
+	if etag := entry.Header.Get("ETag"); etag != "" && r.GetHeader("If-None-Match") == "" {
+		conditions["If-None-Match"] = etag
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" && r.GetHeader("If-Modified-Since") == "" {
+		conditions["If-Modified-Since"] = lastModified
+	}
+	for k, v := range conditions {
+		r.GetHeaders().Set(k, v)
+	}
+
+	requestTime := time.Now()
+	err := next()
+	for k := range conditions {
+		r.GetHeaders().Del(k)
+	}
+
+	res := ctx.GetRes()
+	if err != nil || res == nil || res.GetStatusCode() >= 500 {
+		// serve the stale response if the server fails, see RFC 5861
+		sie, ok := cacheSeconds(respCC, "stale-if-error")
+		if reqSie, reqOk := cacheSeconds(reqCC, "stale-if-error"); reqOk {
+			sie, ok = reqSie, true
+		}
+		if ok && age < lifetime+sie {
+			ctx.SetRes(entry.response(age))
+			return nil
+		}
+
+		return err
+	}
+
+	if res.GetStatusCode() == http.StatusNotModified && len(conditions) > 0 {
+		// update the headers of cached response, the body is not changed
+		for k, vs := range res.GetHeaders() {
+			if k == "Content-Length" {
+				continue
+			}
+			entry.Header[k] = vs
+		}
+		entry.RequestTime = requestTime
+		entry.ResponseTime = time.Now()
+		c.put(key, entries, entry)
+
+		ctx.SetRes(entry.response(entry.age(time.Now())))
+		return nil
+	}
+
+	c.save(key, entries, r, res, requestTime)
+
+	return nil
+}
+
+// Revalidate the stale response in background, by a copy of request with the same middlewares.
+func (c *cache) revalidate(key string, r Request) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	req := r.Clone().SetContext(context.WithValue(context.Background(), cacheRevalidateKey{}, true))
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+
+		_, _ = req.Do()
+	}()
+}
+
+// Load the cached variants of key, the broken data of store is treated as cache miss.
+func (c *cache) load(key string) []*cacheEntry {
+	data, ok, err := c.store.Get(key)
+	if err != nil || !ok {
+		return nil
+	}
+
+	var entries []*cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil
+	}
+
+	return entries
+}
+
+// Store the response if it is cacheable.
+func (c *cache) save(key string, entries []*cacheEntry, r Request, res Response, requestTime time.Time) {
+	if res == nil || !isCacheable(r, res) {
+		return
+	}
+
+	entry := &cacheEntry{
+		StatusCode:   res.GetStatusCode(),
+		Status:       res.GetStatusText(),
+		Proto:        res.GetProto(),
+		Header:       cloneHeader(res.GetHeaders()),
+		Body:         res.GetBody().GetData(),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+		Vary:         map[string]string{},
+	}
+	for _, name := range varyHeaders(entry.Header) {
+		entry.Vary[name] = r.GetHeader(name)
+	}
+
+	c.put(key, entries, entry)
+}
+
+// Put the entry into the variants, the variant of same Vary values is replaced.
+func (c *cache) put(key string, entries []*cacheEntry, entry *cacheEntry) {
+	variants := []*cacheEntry{entry}
+	for _, e := range entries {
+		if e != entry && !reflect.DeepEqual(e.Vary, entry.Vary) && len(variants) < maxCacheVariants {
+			variants = append(variants, e)
+		}
+	}
+
+	data, err := json.Marshal(variants)
+	if err != nil {
+		return
+	}
+	_ = c.store.Set(key, data)
+}
+
+// The url of request without fragment, include the queries.
+func cacheUrl(r Request) string {
+	u := r.GetRawUrl()
+	if i := strings.IndexByte(u, '#'); i >= 0 {
+		u = u[:i]
+	}
+
+	return u
+}
+
+// Find the variant matches the request headers named by Vary.
+func matchCacheEntry(entries []*cacheEntry, headers http.Header) *cacheEntry {
+	for _, e := range entries {
+		matched := true
+		for name, value := range e.Vary {
+			if headers.Get(name) != value {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Whether the response can be stored, see RFC 7234 section 3.
+func isCacheable(r Request, res Response) bool {
+	reqCC := parseCacheControl(r.GetHeaders())
+	respCC := parseCacheControl(res.GetHeaders())
+
+	if _, ok := respCC["no-store"]; ok {
+		return false
+	}
+	for _, name := range varyHeaders(res.GetHeaders()) {
+		if name == "*" {
+			return false
+		}
+	}
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+
+	_, public := respCC["public"]
+	_, maxAge := respCC["max-age"]
+	_, sMaxAge := respCC["s-maxage"]
+	_, mustRevalidate := respCC["must-revalidate"]
+	expires := res.GetHeaders().Get("Expires") != ""
+
+	// the authorized response is cached only if it is allowed explicitly, see RFC 7234 section 3.2
+	if r.GetHeader("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+
+	return cacheableStatusCodes[res.GetStatusCode()] || ((public || maxAge || expires) && res.GetStatusCode() < 500)
+}
+
+// Whether the response of age is fresh enough for the request directives, see RFC 7234 section 5.2.1
+func isCacheFresh(age, lifetime time.Duration, reqCC map[string]string, mustRevalidate bool) bool {
+	if maxAge, ok := cacheSeconds(reqCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := cacheSeconds(reqCC, "min-fresh"); ok {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// the client accepts the stale response
+	if maxStale, ok := reqCC["max-stale"]; ok && !mustRevalidate {
+		if maxStale == "" {
+			return true
+		}
+		if seconds, err := strconv.Atoi(maxStale); err == nil {
+			return age < lifetime+time.Duration(seconds)*time.Second
+		}
+	}
+
+	return false
+}
+
+// The current age of response, see RFC 7234 section 4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	var ageValue time.Duration
+	if seconds, err := strconv.Atoi(e.Header.Get("Age")); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// The freshness lifetime of response, see RFC 7234 section 4.2.1
+func (e *cacheEntry) freshnessLifetime(cc map[string]string) time.Duration {
+	if maxAge, ok := cacheSeconds(cc, "max-age"); ok {
+		return maxAge
+	}
+
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// the invalid date represents a time in the past
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+
+	// heuristic freshness is 10% of the time since last modified, see RFC 7234 section 4.2.2
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && cacheableStatusCodes[e.StatusCode] {
+		if lifetime := e.date().Sub(lastModified) / 10; lifetime > 0 {
+			return lifetime
+		}
+	}
+
+	return 0
+}
+
+// The Date header of response, it is the response time if Date is not present.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+
+	return e.ResponseTime
+}
+
+// Create the response served from cache.
+func (e *cacheEntry) response(age time.Duration) Response {
+	headers := cloneHeader(e.Header)
+	headers.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+
+	return &iresponse{
+		StatusCode: e.StatusCode,
+		StatusText: e.Status,
+		Proto:      e.Proto,
+		Headers:    headers,
+		Body:       &Body{data: e.Body, contentType: headers.Get("Content-Type")},
+		HttpResp: &http.Response{
+			Status:        e.Status,
+			StatusCode:    e.StatusCode,
+			Proto:         e.Proto,
+			Header:        headers,
+			Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+			ContentLength: int64(len(e.Body)),
+		},
+		FromCache: true,
+	}
+}
+
+// The response of only-if-cached request which is not cached, see RFC 7234 section 5.2.1.7
+func newGatewayTimeoutResponse() Response {
+	return &iresponse{
+		StatusCode: http.StatusGatewayTimeout,
+		StatusText: fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+		Headers:    http.Header{},
+		Body:       &Body{},
+		FromCache:  true,
+	}
+}
+
+// Parse the directives of Cache-Control headers, the names are in lower case.
+func parseCacheControl(headers http.Header) map[string]string {
+	cc := map[string]string{}
+
+	for _, header := range headers["Cache-Control"] {
+		for _, directive := range strings.Split(header, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+
+	return cc
+}
+
+// Get the seconds of directive, such as max-age=60
+func cacheSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// The request headers named by the Vary header of response, in canonical format.
+func varyHeaders(headers http.Header) []string {
+	var names []string
+	for _, header := range headers["Vary"] {
+		for _, name := range strings.Split(header, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// The in-memory cache store, the least recently used data is evicted if it is full.
+type LruCacheStore struct {
+	capacity int
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type lruItem struct {
+	key  string
+	data []byte
+}
+
+func NewLruCacheStore(capacity int) *LruCacheStore {
+	if capacity <= 0 {
+		capacity = DefaultCacheCapacity
+	}
+
+	return &LruCacheStore{capacity: capacity, items: map[string]*list.Element{}, order: list.New()}
+}
+
+func (s *LruCacheStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	s.order.MoveToFront(e)
+
+	return e.Value.(*lruItem).data, true, nil
+}
+
+func (s *LruCacheStore) Set(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		e.Value.(*lruItem).data = data
+		s.order.MoveToFront(e)
+		return nil
+	}
+
+	s.items[key] = s.order.PushFront(&lruItem{key: key, data: data})
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*lruItem).key)
+	}
+
+	return nil
+}
+
+func (s *LruCacheStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.order.Remove(e)
+		delete(s.items, key)
+	}
+
+	return nil
+}
+
+// The number of cached keys
+func (s *LruCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
+
+// The on-disk cache store, every key is saved to a file named by the SHA-256 of key.
+type DiskCacheStore struct {
+	Dir string
+}
+
+// Create the disk cache store, the directory is created if it does not exist.
+func NewDiskCacheStore(dir string) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &DiskCacheStore{Dir: dir}, nil
+}
+
+func (s *DiskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskCacheStore) Get(key string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+func (s *DiskCacheStore) Set(key string, data []byte) error {
+	return writeFileAtomic(s.path(key), data)
+}
+
+func (s *DiskCacheStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,255 @@
+package isuperagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// The certificates of https, shared by request and client.
+//
+// The certificates are parsed at the first time they are used, then cached until they are changed,
+// so the files are not read again for every request.
+type certificates struct {
+	// Optionally override the trusted CA certificates.
+	// Default is to trust the well-known CAs curated by Mozilla
+	Ca string
+	// CA certificates in PEM format, appended to the CA file
+	CaPem []byte
+	// Cert chains in PEM format.
+	// One cert chain should be provided per private key
+	Cert string
+	// Private keys in PEM format.
+	// PEM allows the option of private keys being encrypted
+	Key string
+	// Cert chain and private key in PEM format
+	CertPem []byte
+	KeyPem  []byte
+	// The password to decrypt the encrypted PEM private key
+	KeyPassword string
+	// PKCS#12 bundle which contains the client certificate and private key
+	Pkcs12         []byte
+	Pkcs12Password string
+	// Parsed client certificates
+	Certificates []tls.Certificate
+
+	mu          sync.Mutex
+	loaded      bool
+	rootCAs     *x509.CertPool
+	clientCerts []tls.Certificate
+}
+
+// Copy the certificate options, the parsed certificates are not copied.
+func (c *certificates) copyFrom(from *certificates) {
+	c.Ca = from.Ca
+	c.CaPem = from.CaPem
+	c.Cert = from.Cert
+	c.Key = from.Key
+	c.CertPem = from.CertPem
+	c.KeyPem = from.KeyPem
+	c.KeyPassword = from.KeyPassword
+	c.Pkcs12 = from.Pkcs12
+	c.Pkcs12Password = from.Pkcs12Password
+	c.Certificates = from.Certificates
+}
+
+// Whether the CA certificates are set
+func (c *certificates) hasRootCAs() bool {
+	return c.Ca != "" || len(c.CaPem) > 0
+}
+
+// Whether the client certificates are set
+func (c *certificates) hasClientCerts() bool {
+	return (c.Cert != "" && c.Key != "") || len(c.CertPem) > 0 || len(c.Pkcs12) > 0 || len(c.Certificates) > 0
+}
+
+// Drop the cached certificates after they are changed.
+func (c *certificates) invalidate() {
+	c.mu.Lock()
+	c.loaded = false
+	c.rootCAs = nil
+	c.clientCerts = nil
+	c.mu.Unlock()
+}
+
+// Get the pool of CA certificates, nil if CA certificates are not set.
+func (c *certificates) getRootCAs() (*x509.CertPool, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c.rootCAs, nil
+}
+
+// Get the client certificates, nil if client certificates are not set.
+func (c *certificates) getClientCertificates() ([]tls.Certificate, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c.clientCerts, nil
+}
+
+func (c *certificates) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded {
+		return nil
+	}
+
+	var rootCAs *x509.CertPool
+	if c.hasRootCAs() {
+		caPem := append([]byte{}, c.CaPem...)
+		if c.Ca != "" {
+			bs, err := ioutil.ReadFile(c.Ca)
+			if err != nil {
+				return err
+			}
+			caPem = append(append(caPem, '\n'), bs...)
+		}
+
+		pool, err := NewCertPool(caPem)
+		if err != nil {
+			return err
+		}
+		rootCAs = pool
+	}
+
+	clientCerts := append([]tls.Certificate{}, c.Certificates...)
+
+	if c.Cert != "" && c.Key != "" {
+		certPem, err := ioutil.ReadFile(c.Cert)
+		if err != nil {
+			return err
+		}
+		keyPem, err := ioutil.ReadFile(c.Key)
+		if err != nil {
+			return err
+		}
+
+		cert, err := LoadX509KeyPair(certPem, keyPem, c.KeyPassword)
+		if err != nil {
+			return err
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+
+	if len(c.CertPem) > 0 {
+		cert, err := LoadX509KeyPair(c.CertPem, c.KeyPem, c.KeyPassword)
+		if err != nil {
+			return err
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+
+	if len(c.Pkcs12) > 0 {
+		cert, err := LoadPkcs12(c.Pkcs12, c.Pkcs12Password)
+		if err != nil {
+			return err
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+
+	c.rootCAs = rootCAs
+	c.clientCerts = nil
+	if len(clientCerts) > 0 {
+		c.clientCerts = clientCerts
+	}
+	c.loaded = true
+
+	return nil
+}
+
+// Create the pool of CA certificates in PEM format,
+// returns error if the bundle contains no valid certificate.
+func NewCertPool(caPem []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("no valid certificate found in CA bundle")
+	}
+
+	return pool, nil
+}
+
+// Parse the certificate and private key in PEM format,
+// the private key is decrypted by the password if it is encrypted.
+func LoadX509KeyPair(certPem, keyPem []byte, password string) (tls.Certificate, error) {
+	// the key may be in the same file of cert
+	if len(keyPem) == 0 {
+		keyPem = certPem
+	}
+
+	keyPem, err := decryptPemKey(keyPem, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+// Decrypt the encrypted private key block of PEM, other blocks are returned as is.
+func decryptPemKey(data []byte, password string) ([]byte, error) {
+	var out []byte
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		// PKCS#8 encrypted private key, the default of OpenSSL since 1.1
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			if password == "" {
+				return nil, errors.New("private key is encrypted, but the password is not set")
+			}
+
+			der, err := decryptPkcs8(block.Bytes, password)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		}
+
+		// The legacy encrypted PEM with Proc-Type and DEK-Info headers, such as: openssl rsa -aes256
+		if x509.IsEncryptedPEMBlock(block) {
+			if password == "" {
+				return nil, errors.New("private key is encrypted, but the password is not set")
+			}
+
+			der, err := x509.DecryptPEMBlock(block, []byte(password))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("failed to decrypt private key: %s", err))
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		}
+
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+
+	return out, nil
+}
+
+// Parse the PKCS#12 bundle which contains the client certificate, private key and optional CA certificates.
+// Only the legacy algorithms (3DES and RC2 with SHA-1) are supported, the bundle created by OpenSSL 3
+// must be exported with -legacy.
+func LoadPkcs12(data []byte, password string) (tls.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	var pemData []byte
+	for _, block := range blocks {
+		pemData = append(pemData, pem.EncodeToMemory(block)...)
+	}
+
+	return tls.X509KeyPair(pemData, pemData)
+}
@@ -0,0 +1,283 @@
+package isuperagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+// The states of circuit breaker
+const (
+	// The requests are sent, the failures are counted
+	CircuitClosed = "closed"
+	// The requests are rejected with *error.CircuitOpenError
+	CircuitOpen = "open"
+	// The probe requests are sent to tell whether the server is recovered
+	CircuitHalfOpen = "half_open"
+)
+
+// The defaults of circuit breaker
+const (
+	DefaultCircuitWindow       = 10 * time.Second
+	DefaultCircuitMinRequests  = 10
+	DefaultCircuitFailureRatio = 0.5
+	DefaultCircuitOpenTimeout  = 30 * time.Second
+)
+
+// The number of buckets of rolling window
+const circuitWindowBuckets = 10
+
+type CircuitBreakerConfig struct {
+	// The key of circuits, default is KeyByHost, every key has its own circuit
+	Key KeyFunc
+	// Whether the request fails, default is the transport error, 5xx responses, and the requests slower than SlowThreshold.
+	// The requests canceled by the caller are neither failures nor successes, they are not counted.
+	IsFailure func(res Response, err error, latency time.Duration) bool
+	// The request slower than it is a failure, 0 is disabled
+	SlowThreshold time.Duration
+	// The rolling window of statistics, default is DefaultCircuitWindow
+	Window time.Duration
+	// The min requests in window to open the circuit, default is DefaultCircuitMinRequests
+	MinRequests int
+	// Open the circuit if the ratio of failures in window reaches it, default is DefaultCircuitFailureRatio
+	FailureRatio float64
+	// The time to wait in open before half-open, default is DefaultCircuitOpenTimeout
+	OpenTimeout time.Duration
+	// The probe requests in half-open, the circuit is closed after all of them succeed, default is 1
+	HalfOpenProbes int
+	// Called after the state of circuit is changed
+	OnStateChange func(key, from, to string)
+}
+
+type circuitBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+type circuit struct {
+	mu       sync.Mutex
+	state    string
+	openedAt time.Time
+	buckets  [circuitWindowBuckets]circuitBucket
+	// The probes in flight and succeeded in half-open
+	probes    int
+	successes int
+}
+
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// Middleware: circuit breaker
+//
+// Every key has a circuit, it is opened if the ratio of failures in the rolling window reaches FailureRatio,
+// then the requests are rejected with *error.CircuitOpenError until OpenTimeout.
+// After that, the circuit is half-open and HalfOpenProbes requests are sent,
+// it is closed if all of them succeed, or opened again if any of them fails.
+// The middleware is created by an optional *CircuitBreakerConfig, such as:
+//
+//	isuperagent.NewMiddleware("circuit_breaker", &isuperagent.CircuitBreakerConfig{SlowThreshold: time.Second})
+func NewCircuitBreakerMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	var config CircuitBreakerConfig
+	if len(v) > 0 {
+		switch c := v[0].(type) {
+		case *CircuitBreakerConfig:
+			config = *c
+		case CircuitBreakerConfig:
+			config = c
+		default:
+			return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.CircuitBreakerConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+		}
+	}
+
+	if config.Key == nil {
+		config.Key = KeyByHost
+	}
+	if config.IsFailure == nil {
+		threshold := config.SlowThreshold
+		config.IsFailure = func(res Response, err error, latency time.Duration) bool {
+			if err != nil {
+				return true
+			}
+			if res != nil && res.GetStatusCode() >= 500 {
+				return true
+			}
+			return threshold > 0 && latency > threshold
+		}
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultCircuitWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultCircuitMinRequests
+	}
+	if config.FailureRatio <= 0 || config.FailureRatio > 1 {
+		config.FailureRatio = DefaultCircuitFailureRatio
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultCircuitOpenTimeout
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+
+	cb := &circuitBreaker{config: config, circuits: map[string]*circuit{}}
+
+	return func(ctx Context, next Next) error {
+		key := config.Key(ctx.GetReq())
+		if key == "" {
+			return next()
+		}
+		c := cb.circuit(key)
+
+		probe, err := cb.allow(key, c, time.Now())
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err = next()
+		if err != nil && isCanceled(err) {
+			cb.ignore(c, probe)
+			return err
+		}
+		failure := config.IsFailure(ctx.GetRes(), err, time.Since(start))
+		cb.record(key, c, probe, failure, time.Now())
+
+		return err
+	}, nil
+}
+
+func (cb *circuitBreaker) circuit(key string) *circuit {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		cb.circuits[key] = c
+	}
+
+	return c
+}
+
+// Whether the request is allowed, and whether it is a probe of half-open circuit.
+func (cb *circuitBreaker) allow(key string, c *circuit, now time.Time) (bool, error) {
+	c.mu.Lock()
+
+	from := c.state
+	if c.state == CircuitOpen {
+		if retryAfter := c.openedAt.Add(cb.config.OpenTimeout).Sub(now); retryAfter > 0 {
+			c.mu.Unlock()
+			return false, &ierror.CircuitOpenError{Key: key, State: CircuitOpen, RetryAfter: retryAfter}
+		}
+		c.state, c.probes, c.successes = CircuitHalfOpen, 0, 0
+	}
+
+	if c.state == CircuitHalfOpen {
+		if c.probes+c.successes >= cb.config.HalfOpenProbes {
+			c.mu.Unlock()
+			cb.changed(key, from, CircuitHalfOpen)
+			return false, &ierror.CircuitOpenError{Key: key, State: CircuitHalfOpen}
+		}
+		c.probes++
+		c.mu.Unlock()
+		cb.changed(key, from, CircuitHalfOpen)
+		return true, nil
+	}
+
+	c.mu.Unlock()
+
+	return false, nil
+}
+
+// Record the result of request.
+func (cb *circuitBreaker) record(key string, c *circuit, probe, failure bool, now time.Time) {
+	c.mu.Lock()
+
+	from := c.state
+	switch {
+	case probe:
+		// the result of probe is ignored if the circuit is changed by other probes
+		if c.state != CircuitHalfOpen {
+			break
+		}
+		c.probes--
+		if failure {
+			c.state, c.openedAt = CircuitOpen, now
+		} else if c.successes++; c.successes >= cb.config.HalfOpenProbes {
+			c.state = CircuitClosed
+			c.buckets = [circuitWindowBuckets]circuitBucket{}
+		}
+	case c.state == CircuitClosed:
+		total, failures := c.add(now, failure, cb.config.Window)
+		if total >= cb.config.MinRequests && float64(failures) >= float64(total)*cb.config.FailureRatio {
+			c.state, c.openedAt = CircuitOpen, now
+		}
+	}
+
+	to := c.state
+	c.mu.Unlock()
+
+	cb.changed(key, from, to)
+}
+
+// Ignore the canceled request, the probe of half-open circuit is released, so another probe can be sent.
+func (cb *circuitBreaker) ignore(c *circuit, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probe && c.state == CircuitHalfOpen {
+		c.probes--
+	}
+}
+
+// Add the result to the rolling window, returns the requests and failures in window.
+func (c *circuit) add(now time.Time, failure bool, window time.Duration) (int, int) {
+	width := window / circuitWindowBuckets
+	start := now.Truncate(width)
+
+	b := &c.buckets[int(start.UnixNano()/int64(width))%circuitWindowBuckets]
+	if !b.start.Equal(start) {
+		*b = circuitBucket{start: start}
+	}
+	b.total++
+	if failure {
+		b.failures++
+	}
+
+	total, failures := 0, 0
+	for _, b := range c.buckets {
+		if now.Sub(b.start) < window {
+			total += b.total
+			failures += b.failures
+		}
+	}
+
+	return total, failures
+}
+
+func (cb *circuitBreaker) changed(key, from, to string) {
+	if from != to && cb.config.OnStateChange != nil {
+		cb.config.OnStateChange(key, from, to)
+	}
+}
+
+// Whether the request is canceled by the caller, the error of http.Client is wrapped by *url.Error.
+func isCanceled(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+
+	return err == context.Canceled
+}
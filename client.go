@@ -0,0 +1,667 @@
+package isuperagent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client holds the options shared by many requests.
+//
+// Requests created by the client inherit its options, the options set on the request take precedence.
+// All of the requests which not override the transport options share one http.Transport,
+// so the connections are reused between them.
+type Client interface {
+	NewRequest() Request
+	NewRequestWithContext(ctx context.Context) Request
+
+	SetTimeout(d time.Duration) Client
+	GetTimeout() time.Duration
+	SetDialTimeout(d time.Duration) Client
+	GetDialTimeout() time.Duration
+	SetTlsHandshakeTimeout(d time.Duration) Client
+	GetTlsHandshakeTimeout() time.Duration
+	SetResponseHeaderTimeout(d time.Duration) Client
+	GetResponseHeaderTimeout() time.Duration
+	SetExpectContinueTimeout(d time.Duration) Client
+	GetExpectContinueTimeout() time.Duration
+	SetIdleConnTimeout(d time.Duration) Client
+	GetIdleConnTimeout() time.Duration
+
+	SetProxy(proxyUrl string) Client
+	GetProxy() string
+	SetNoProxy(noProxy string) Client
+	GetNoProxy() string
+	SetProxyFunc(fn ProxyFunc) Client
+	GetProxyFunc() ProxyFunc
+	SetUnixSocket(socket string) Client
+	GetUnixSocket() string
+	SetDialContext(fn DialContextFunc) Client
+	GetDialContext() DialContextFunc
+	Resolve(hostPort, ip string) Client
+	GetResolves() map[string]string
+	SetResolver(resolver Resolver) Client
+	GetResolver() Resolver
+	SetInsecureSkipVerify(insecureSkipVerify bool) Client
+	GetInsecureSkipVerify() bool
+	SetTlsConfig(tlsConfig *tls.Config) Client
+	GetTlsConfig() *tls.Config
+	SetTlsMinVersion(version uint16) Client
+	GetTlsMinVersion() uint16
+	SetTlsMaxVersion(version uint16) Client
+	GetTlsMaxVersion() uint16
+	SetCipherSuites(suites ...uint16) Client
+	GetCipherSuites() []uint16
+	SetCurvePreferences(curves ...tls.CurveID) Client
+	GetCurvePreferences() []tls.CurveID
+	SetServerName(serverName string) Client
+	GetServerName() string
+	SetHttp2(enable bool) Client
+	GetHttp2() bool
+	SetCa(caPath string) Client
+	GetCa() string
+	SetCaPem(caPem []byte) Client
+	SetCert(certPath, keyPath string) Client
+	GetCert() (string, string)
+	SetCertPem(certPem, keyPem []byte) Client
+	SetKeyPassword(password string) Client
+	SetPkcs12(data []byte, password string) Client
+	SetCertificates(certs ...tls.Certificate) Client
+	GetRootCAs() (*x509.CertPool, error)
+	GetClientCertificates() ([]tls.Certificate, error)
+	WatchCertificates(interval time.Duration, onError func(err error)) Client
+	SetPublicKeyPins(pins ...string) Client
+	GetPublicKeyPins() []string
+	VerifyPeer(fn VerifyPeerFunc) Client
+	GetVerifyPeer() VerifyPeerFunc
+	SetHttpClient(c *http.Client) Client
+	GetHttpClient() *http.Client
+	SetTransport(tr http.RoundTripper) Client
+	GetTransport() http.RoundTripper
+	SetCookieJar(jar http.CookieJar) Client
+	GetCookieJar() http.CookieJar
+	Redirects(n int) Client
+	GetMaxRedirects() int
+	SetRedirectPolicy(fn RedirectPolicy) Client
+	GetRedirectPolicy() RedirectPolicy
+	SetRedirectAuth(rule string) Client
+	GetRedirectAuth() string
+	SetRedirectMethodRule(rule RedirectMethodRule) Client
+	GetRedirectMethodRule() RedirectMethodRule
+
+	Middleware(middleware ...Middleware) Client
+	GetMiddlewares() []Middleware
+
+	CloseIdleConnections()
+}
+
+type iclient struct {
+	// Overall timeout of the request, see http.Client.Timeout
+	Timeout time.Duration
+
+	// Fine-grained timeouts of the transport, see http.Transport
+	DialTimeout           time.Duration
+	TlsHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	ExpectContinueTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	// Proxy options, see Request.SetProxy
+	Proxy     string
+	NoProxy   string
+	ProxyFunc ProxyFunc
+
+	// Connection options, see Request.SetUnixSocket and Request.SetDialContext
+	UnixSocket  string
+	DialContext DialContextFunc
+
+	// DNS options, see Request.Resolve and Request.SetResolver
+	Resolves map[string]string
+	Resolver Resolver
+
+	// Https options, see Request
+	certificates
+	reloader           *certReloader
+	InsecureSkipVerify bool
+	TlsConfig          *tls.Config
+	TlsMinVersion      uint16
+	TlsMaxVersion      uint16
+	CipherSuites       []uint16
+	CurvePreferences   []tls.CurveID
+	ServerName         string
+	Http2              *bool
+
+	// Server certificate verification, see Request.SetPublicKeyPins and Request.VerifyPeer
+	PublicKeyPins  []string
+	VerifyPeerFunc VerifyPeerFunc
+
+	// The http client or transport of user, see Request.SetHttpClient and Request.SetTransport
+	HttpClient *http.Client
+	Transport  http.RoundTripper
+
+	// The cookie jar shared by all requests, see Request.SetCookieJar
+	CookieJar http.CookieJar
+
+	// The redirect options, see Request.Redirects
+	MaxRedirects       *int
+	RedirectPolicy     RedirectPolicy
+	RedirectAuth       string
+	RedirectMethodRule RedirectMethodRule
+
+	// Middlewares applied to every request, before the middlewares of the request
+	Middlewares []Middleware
+
+	mu        sync.Mutex
+	transport *http.Transport
+}
+
+func NewClient() Client {
+	return &iclient{}
+}
+
+func (c *iclient) NewRequest() Request {
+	return c.NewRequestWithContext(context.Background())
+}
+
+func (c *iclient) NewRequestWithContext(ctx context.Context) Request {
+	return &irequest{Context: ctx, Client: c, Url: NewURL(), Headers: http.Header{}}
+}
+
+func (c *iclient) SetTimeout(d time.Duration) Client {
+	c.Timeout = d
+
+	return c
+}
+
+func (c *iclient) GetTimeout() time.Duration {
+	return c.Timeout
+}
+
+func (c *iclient) SetDialTimeout(d time.Duration) Client {
+	c.DialTimeout = d
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetDialTimeout() time.Duration {
+	return c.DialTimeout
+}
+
+func (c *iclient) SetTlsHandshakeTimeout(d time.Duration) Client {
+	c.TlsHandshakeTimeout = d
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetTlsHandshakeTimeout() time.Duration {
+	return c.TlsHandshakeTimeout
+}
+
+func (c *iclient) SetResponseHeaderTimeout(d time.Duration) Client {
+	c.ResponseHeaderTimeout = d
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetResponseHeaderTimeout() time.Duration {
+	return c.ResponseHeaderTimeout
+}
+
+func (c *iclient) SetExpectContinueTimeout(d time.Duration) Client {
+	c.ExpectContinueTimeout = d
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetExpectContinueTimeout() time.Duration {
+	return c.ExpectContinueTimeout
+}
+
+func (c *iclient) SetIdleConnTimeout(d time.Duration) Client {
+	c.IdleConnTimeout = d
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetIdleConnTimeout() time.Duration {
+	return c.IdleConnTimeout
+}
+
+func (c *iclient) SetProxy(proxyUrl string) Client {
+	c.Proxy = proxyUrl
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetProxy() string {
+	return c.Proxy
+}
+
+func (c *iclient) SetNoProxy(noProxy string) Client {
+	c.NoProxy = noProxy
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetNoProxy() string {
+	return c.NoProxy
+}
+
+func (c *iclient) SetProxyFunc(fn ProxyFunc) Client {
+	c.ProxyFunc = fn
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetProxyFunc() ProxyFunc {
+	return c.ProxyFunc
+}
+
+func (c *iclient) SetUnixSocket(socket string) Client {
+	c.UnixSocket = socket
+
+	return c
+}
+
+func (c *iclient) GetUnixSocket() string {
+	return c.UnixSocket
+}
+
+func (c *iclient) SetDialContext(fn DialContextFunc) Client {
+	c.DialContext = fn
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetDialContext() DialContextFunc {
+	return c.DialContext
+}
+
+func (c *iclient) Resolve(hostPort, ip string) Client {
+	if c.Resolves == nil {
+		c.Resolves = map[string]string{}
+	}
+	c.Resolves[hostPort] = ip
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetResolves() map[string]string {
+	return c.Resolves
+}
+
+func (c *iclient) SetResolver(resolver Resolver) Client {
+	c.Resolver = resolver
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetResolver() Resolver {
+	return c.Resolver
+}
+
+func (c *iclient) SetInsecureSkipVerify(insecureSkipVerify bool) Client {
+	c.InsecureSkipVerify = insecureSkipVerify
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetInsecureSkipVerify() bool {
+	return c.InsecureSkipVerify
+}
+
+func (c *iclient) SetTlsConfig(tlsConfig *tls.Config) Client {
+	c.TlsConfig = tlsConfig
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetTlsConfig() *tls.Config {
+	return c.TlsConfig
+}
+
+func (c *iclient) SetTlsMinVersion(version uint16) Client {
+	c.TlsMinVersion = version
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetTlsMinVersion() uint16 {
+	return c.TlsMinVersion
+}
+
+func (c *iclient) SetTlsMaxVersion(version uint16) Client {
+	c.TlsMaxVersion = version
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetTlsMaxVersion() uint16 {
+	return c.TlsMaxVersion
+}
+
+func (c *iclient) SetCipherSuites(suites ...uint16) Client {
+	c.CipherSuites = suites
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetCipherSuites() []uint16 {
+	return c.CipherSuites
+}
+
+func (c *iclient) SetCurvePreferences(curves ...tls.CurveID) Client {
+	c.CurvePreferences = curves
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetCurvePreferences() []tls.CurveID {
+	return c.CurvePreferences
+}
+
+func (c *iclient) SetServerName(serverName string) Client {
+	c.ServerName = serverName
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetServerName() string {
+	return c.ServerName
+}
+
+func (c *iclient) SetHttp2(enable bool) Client {
+	c.Http2 = &enable
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetHttp2() bool {
+	return c.Http2 == nil || *c.Http2
+}
+
+func (c *iclient) SetCa(caPath string) Client {
+	c.Ca = caPath
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) GetCa() string {
+	return c.Ca
+}
+
+func (c *iclient) SetCaPem(caPem []byte) Client {
+	c.CaPem = caPem
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) SetCert(certPath, keyPath string) Client {
+	c.Cert = certPath
+	c.Key = keyPath
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) GetCert() (string, string) {
+	return c.Cert, c.Key
+}
+
+func (c *iclient) SetCertPem(certPem, keyPem []byte) Client {
+	c.CertPem = certPem
+	c.KeyPem = keyPem
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) SetKeyPassword(password string) Client {
+	c.KeyPassword = password
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) SetPkcs12(data []byte, password string) Client {
+	c.Pkcs12 = data
+	c.Pkcs12Password = password
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) SetCertificates(certs ...tls.Certificate) Client {
+	c.Certificates = certs
+	c.certsChanged()
+
+	return c
+}
+
+func (c *iclient) GetRootCAs() (*x509.CertPool, error) {
+	if c.reloader != nil {
+		if _, err := c.reloader.check(); err != nil {
+			return nil, err
+		}
+
+		return c.reloader.getRootCAs(), nil
+	}
+
+	return c.getRootCAs()
+}
+
+func (c *iclient) GetClientCertificates() ([]tls.Certificate, error) {
+	if c.reloader != nil {
+		if _, err := c.reloader.check(); err != nil {
+			return nil, err
+		}
+
+		return c.reloader.getClientCertificates(), nil
+	}
+
+	return c.getClientCertificates()
+}
+
+// Reload the certificate files passed to SetCa and SetCert when they are changed,
+// such as the certificates rotated by a sidecar.
+// The files are checked at most once per interval when the client sends requests,
+// the in-flight requests are not affected by the reload.
+// If the reload failed, onError is called and the previous certificates are kept.
+func (c *iclient) WatchCertificates(interval time.Duration, onError func(err error)) Client {
+	c.reloader = newCertReloader(&c.certificates, interval, onError)
+	c.reset()
+
+	return c
+}
+
+// Drop the cached certificates and the shared transport after the certificates changed.
+func (c *iclient) certsChanged() {
+	c.invalidate()
+	if c.reloader != nil {
+		c.reloader.forget()
+	}
+	c.reset()
+}
+
+func (c *iclient) SetPublicKeyPins(pins ...string) Client {
+	c.PublicKeyPins = pins
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetPublicKeyPins() []string {
+	return c.PublicKeyPins
+}
+
+func (c *iclient) VerifyPeer(fn VerifyPeerFunc) Client {
+	c.VerifyPeerFunc = fn
+	c.reset()
+
+	return c
+}
+
+func (c *iclient) GetVerifyPeer() VerifyPeerFunc {
+	return c.VerifyPeerFunc
+}
+
+func (c *iclient) SetHttpClient(hc *http.Client) Client {
+	c.HttpClient = hc
+
+	return c
+}
+
+func (c *iclient) GetHttpClient() *http.Client {
+	return c.HttpClient
+}
+
+func (c *iclient) SetTransport(tr http.RoundTripper) Client {
+	c.Transport = tr
+
+	return c
+}
+
+func (c *iclient) GetTransport() http.RoundTripper {
+	return c.Transport
+}
+
+func (c *iclient) SetCookieJar(jar http.CookieJar) Client {
+	c.CookieJar = jar
+
+	return c
+}
+
+func (c *iclient) GetCookieJar() http.CookieJar {
+	return c.CookieJar
+}
+
+func (c *iclient) Redirects(n int) Client {
+	c.MaxRedirects = &n
+
+	return c
+}
+
+func (c *iclient) GetMaxRedirects() int {
+	if c.MaxRedirects == nil {
+		return DefaultMaxRedirects
+	}
+
+	return *c.MaxRedirects
+}
+
+func (c *iclient) SetRedirectPolicy(fn RedirectPolicy) Client {
+	c.RedirectPolicy = fn
+
+	return c
+}
+
+func (c *iclient) GetRedirectPolicy() RedirectPolicy {
+	return c.RedirectPolicy
+}
+
+func (c *iclient) SetRedirectAuth(rule string) Client {
+	c.RedirectAuth = rule
+
+	return c
+}
+
+func (c *iclient) GetRedirectAuth() string {
+	return c.RedirectAuth
+}
+
+func (c *iclient) SetRedirectMethodRule(rule RedirectMethodRule) Client {
+	c.RedirectMethodRule = rule
+
+	return c
+}
+
+func (c *iclient) GetRedirectMethodRule() RedirectMethodRule {
+	return c.RedirectMethodRule
+}
+
+func (c *iclient) Middleware(middleware ...Middleware) Client {
+	c.Middlewares = append(c.Middlewares, middleware...)
+
+	return c
+}
+
+func (c *iclient) GetMiddlewares() []Middleware {
+	return c.Middlewares
+}
+
+// Close the idle connections of the shared transport.
+func (c *iclient) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+}
+
+// Get the shared transport, it is created by the first request.
+func (c *iclient) getTransport() (*http.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// replace the shared transport if the CA certificates changed, the in-flight requests still use the old one
+	if c.reloader != nil {
+		caChanged, err := c.reloader.check()
+		if err != nil {
+			return nil, err
+		}
+
+		if caChanged && c.transport != nil {
+			c.transport.CloseIdleConnections()
+			c.transport = nil
+		}
+	}
+
+	if c.transport != nil {
+		return c.transport, nil
+	}
+
+	// a request without any override has exactly the options of the client
+	tr, err := newTransport(&irequest{Client: c})
+	if err != nil {
+		return nil, err
+	}
+	c.transport = tr
+
+	return c.transport, nil
+}
+
+// Drop the shared transport after the options changed, the next request will create a new one.
+func (c *iclient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+		c.transport = nil
+	}
+}
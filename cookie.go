@@ -0,0 +1,400 @@
+package isuperagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The cookie stored in jar, with the attributes to persist it.
+type JarCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"http_only"`
+	// The cookie is only sent to the host set it, it is not sent to the sub domains
+	HostOnly bool `json:"host_only"`
+}
+
+// Whether the cookie is a session cookie, which is not persisted
+func (c *JarCookie) IsSession() bool {
+	return c.Expires.IsZero()
+}
+
+func (c *JarCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// CookieStore loads and saves the cookies of jar.
+type CookieStore interface {
+	Load() ([]JarCookie, error)
+	Save(cookies []JarCookie) error
+}
+
+// Cookie jar following RFC 6265, the cookies are not set for public suffixes, such as co.uk.
+//
+// The cookies are loaded from the store when the jar is created,
+// and saved to the store after they are changed, the session cookies are not saved.
+type CookieJar struct {
+	jar   *cookiejar.Jar
+	store CookieStore
+
+	mu      sync.Mutex
+	cookies map[string]*JarCookie
+	err     error
+}
+
+// Create the cookie jar, the store is optional.
+func NewCookieJar(store CookieStore) (*CookieJar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+
+	j := &CookieJar{jar: jar, store: store, cookies: map[string]*JarCookie{}}
+	if store == nil {
+		return j, nil
+	}
+
+	cookies, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, c := range cookies {
+		if c.IsSession() || c.Expires.After(now) {
+			j.restore(c)
+		}
+	}
+
+	return j, nil
+}
+
+// Put the persisted cookie back to jar.
+func (j *CookieJar) restore(c JarCookie) {
+	scheme := "http"
+	if c.Secure {
+		scheme = "https"
+	}
+	u := &url.URL{Scheme: scheme, Host: strings.TrimPrefix(c.Domain, "."), Path: c.Path}
+
+	cookie := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Expires: c.Expires, Secure: c.Secure, HttpOnly: c.HttpOnly}
+	if !c.HostOnly {
+		cookie.Domain = c.Domain
+	}
+	j.jar.SetCookies(u, []*http.Cookie{cookie})
+
+	j.cookies[c.key()] = &c
+}
+
+// Implement http.CookieJar
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// keep the cookies accepted by jar only, such as the cookies of public suffix are rejected
+	accepted := map[string]bool{}
+	for _, c := range j.jar.Cookies(u) {
+		accepted[c.Name+"="+c.Value] = true
+	}
+
+	now := time.Now()
+	changed := false
+	for _, cookie := range cookies {
+		c := newJarCookie(u, cookie, now)
+
+		if cookie.MaxAge < 0 || (!c.IsSession() && !c.Expires.After(now)) {
+			if _, ok := j.cookies[c.key()]; ok {
+				delete(j.cookies, c.key())
+				changed = true
+			}
+			continue
+		}
+
+		// the cookie is rejected by jar if it is not returned for u,
+		// the cookie of other path or secure cookie of http is never returned, trust the jar in this case
+		visible := strings.HasPrefix(u.Path, c.Path) && (!c.Secure || u.Scheme == "https")
+		if visible && !accepted[c.Name+"="+c.Value] {
+			continue
+		}
+
+		j.cookies[c.key()] = c
+		changed = true
+	}
+
+	if changed && j.store != nil {
+		j.err = j.store.Save(j.persistent(now))
+	}
+}
+
+// Implement http.CookieJar
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// Get all of cookies in jar, the expired cookies are excluded.
+func (j *CookieJar) AllCookies() []JarCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	cookies := make([]JarCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if c.IsSession() || c.Expires.After(now) {
+			cookies = append(cookies, *c)
+		}
+	}
+	sortJarCookies(cookies)
+
+	return cookies
+}
+
+// Save the cookies to store, returns the error of last automatic saving if it is not saved again.
+func (j *CookieJar) Save() error {
+	if j.store == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.err = j.store.Save(j.persistent(time.Now()))
+
+	return j.err
+}
+
+// Get the error of last saving.
+func (j *CookieJar) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.err
+}
+
+// The cookies to persist, the session and expired cookies are excluded.
+func (j *CookieJar) persistent(now time.Time) []JarCookie {
+	cookies := make([]JarCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if !c.IsSession() && c.Expires.After(now) {
+			cookies = append(cookies, *c)
+		}
+	}
+	sortJarCookies(cookies)
+
+	return cookies
+}
+
+func newJarCookie(u *url.URL, cookie *http.Cookie, now time.Time) *JarCookie {
+	c := &JarCookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   strings.ToLower(cookie.Domain),
+		Path:     cookie.Path,
+		Expires:  cookie.Expires,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HttpOnly,
+	}
+
+	host := u.Hostname()
+	if c.Domain == "" || net.ParseIP(host) != nil {
+		c.Domain = strings.ToLower(host)
+		c.HostOnly = true
+	} else if !strings.HasPrefix(c.Domain, ".") {
+		c.Domain = "." + c.Domain
+	}
+
+	// the default path is the directory of request path, see RFC 6265 section 5.1.4
+	if c.Path == "" || c.Path[0] != '/' {
+		c.Path = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			c.Path = u.Path[:i]
+		}
+	}
+
+	if cookie.MaxAge > 0 {
+		c.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+	}
+
+	return c
+}
+
+func sortJarCookies(cookies []JarCookie) {
+	sort.Slice(cookies, func(i, k int) bool {
+		return cookies[i].key() < cookies[k].key()
+	})
+}
+
+// Save the cookies to the file in JSON format.
+type JsonCookieStore struct {
+	Path string
+}
+
+func NewJsonCookieStore(path string) *JsonCookieStore {
+	return &JsonCookieStore{Path: path}
+}
+
+// Load the cookies, the file not exists is not an error.
+func (s *JsonCookieStore) Load() ([]JarCookie, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cookies []JarCookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		return nil, err
+	}
+
+	return cookies, nil
+}
+
+func (s *JsonCookieStore) Save(cookies []JarCookie) error {
+	data, err := json.MarshalIndent(cookies, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Path, data)
+}
+
+// Save the cookies to the file in Netscape cookies.txt format, which is used by curl and wget.
+type NetscapeCookieStore struct {
+	Path string
+}
+
+func NewNetscapeCookieStore(path string) *NetscapeCookieStore {
+	return &NetscapeCookieStore{Path: path}
+}
+
+// The prefix of HttpOnly cookies of cookies.txt
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+// Load the cookies, the file not exists is not an error.
+func (s *NetscapeCookieStore) Load() ([]JarCookie, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cookies []JarCookie
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		httpOnly := strings.HasPrefix(line, netscapeHttpOnlyPrefix)
+		if httpOnly {
+			line = strings.TrimPrefix(line, netscapeHttpOnlyPrefix)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expires, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return nil, errors.New(fmt.Sprintf("invalid cookie at line %d of %s", n, s.Path))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid cookie expires at line %d of %s", n, s.Path))
+		}
+
+		c := JarCookie{
+			Domain:   strings.ToLower(fields[0]),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		if !c.HostOnly && !strings.HasPrefix(c.Domain, ".") {
+			c.Domain = "." + c.Domain
+		}
+		cookies = append(cookies, c)
+	}
+
+	return cookies, scanner.Err()
+}
+
+func (s *NetscapeCookieStore) Save(cookies []JarCookie) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n\n")
+
+	bool2str := func(b bool) string {
+		if b {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+
+	for _, c := range cookies {
+		if c.HttpOnly {
+			buf.WriteString(netscapeHttpOnlyPrefix)
+		}
+		var expires int64
+		if !c.IsSession() {
+			expires = c.Expires.Unix()
+		}
+		buf.WriteString(strings.Join([]string{
+			c.Domain, bool2str(!c.HostOnly), c.Path, bool2str(c.Secure), strconv.FormatInt(expires, 10), c.Name, c.Value,
+		}, "\t"))
+		buf.WriteString("\n")
+	}
+
+	return writeFileAtomic(s.Path, buf.Bytes())
+}
+
+// Write the file by renaming a temporary file, so the file is never half written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,298 @@
+package isuperagent
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The digest challenge of server, see RFC 7616
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	stale     bool
+
+	// nonce count, the times the nonce is used
+	nc uint32
+}
+
+// The state of digest auth, shared by all requests using the same middleware,
+// so the nonce is reused and the nonce count increased across requests.
+type digestAuth struct {
+	username string
+	password string
+
+	mu         sync.Mutex
+	challenges map[string]*digestChallenge
+}
+
+// Middleware: HTTP Digest Auth, see RFC 7616
+//
+// The request is sent without authorization at first, then re-sent with the digest response after 401 challenge.
+// The challenge is cached per host, the later requests are authorized preemptively with increased nonce count.
+// MD5, SHA-256 and their -sess variants are supported, with qop=auth, auth-int or without qop (RFC 2069).
+func NewDigestAuthMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 2 {
+		return nil, errors.New("excepted two arguments, the first is username, next is password")
+	}
+
+	var username, password string
+
+	if user, ok := v[0].(string); !ok {
+		return nil, errors.New(fmt.Sprintf("excepted username is string, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	} else {
+		username = user
+	}
+
+	if pass, ok := v[1].(string); !ok {
+		return nil, errors.New(fmt.Sprintf("excepted password is string, but got %v(%s)", v[1], reflect.TypeOf(v[1])))
+	} else {
+		password = pass
+	}
+
+	d := &digestAuth{username: username, password: password, challenges: map[string]*digestChallenge{}}
+
+	return func(ctx Context, next Next) error {
+		r := ctx.GetReq()
+		host := r.GetUrl().Host
+
+		// authorize preemptively by the cached challenge
+		authorized, err := d.authorize(r, host)
+		if err != nil {
+			return err
+		}
+
+		if err := next(); err != nil {
+			return err
+		}
+
+		res := ctx.GetRes()
+		if res == nil || res.GetStatusCode() != http.StatusUnauthorized {
+			return nil
+		}
+
+		challenge := parseDigestChallenges(res.GetHeaders()[http.CanonicalHeaderKey("WWW-Authenticate")])
+		if challenge == nil {
+			return nil
+		}
+
+		// the credentials are wrong if the nonce is not stale
+		if authorized != nil && authorized.nonce == challenge.nonce && !challenge.stale {
+			return nil
+		}
+
+		d.mu.Lock()
+		d.challenges[host] = challenge
+		d.mu.Unlock()
+
+		if _, err := d.authorize(r, host); err != nil {
+			return err
+		}
+
+		return next()
+	}, nil
+}
+
+// Set the Authorization header by the cached challenge of host, returns the challenge used.
+func (d *digestAuth) authorize(r Request, host string) (*digestChallenge, error) {
+	d.mu.Lock()
+	challenge, ok := d.challenges[host]
+	if !ok {
+		d.mu.Unlock()
+		return nil, nil
+	}
+	challenge.nc++
+	nc := challenge.nc
+	c := *challenge
+	d.mu.Unlock()
+
+	u, err := url.Parse(r.GetRawUrl())
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if c.qop == "auth-int" {
+		if body, err = r.GetBodyRaw(); err != nil {
+			return nil, err
+		}
+	}
+
+	authorization, err := digestAuthorization(&c, d.username, d.password, r.GetMethod(), u.RequestURI(), body, nc)
+	if err != nil {
+		return nil, err
+	}
+	r.GetHeaders().Set("Authorization", authorization)
+
+	return &c, nil
+}
+
+// Compute the Authorization header of digest auth.
+func digestAuthorization(c *digestChallenge, username, password, method, uri string, body []byte, nc uint32) (string, error) {
+	algorithm := strings.ToUpper(c.algorithm)
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported digest algorithm %s", c.algorithm))
+	}
+
+	h := func(s string) string {
+		hs := newHash()
+		hs.Write([]byte(s))
+		return hex.EncodeToString(hs.Sum(nil))
+	}
+
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	ncValue := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+
+	ha2 := h(method + ":" + uri)
+	if c.qop == "auth-int" {
+		ha2 = h(method + ":" + uri + ":" + h(string(body)))
+	}
+
+	var response string
+	if c.qop == "" {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ncValue + ":" + cnonce + ":" + c.qop + ":" + ha2)
+	}
+
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		username, c.realm, c.nonce, uri, algorithm, response))
+	if c.opaque != "" {
+		buf.WriteString(fmt.Sprintf(`, opaque="%s"`, c.opaque))
+	}
+	if c.qop != "" {
+		buf.WriteString(fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, c.qop, ncValue, cnonce))
+	}
+
+	return buf.String(), nil
+}
+
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Parse the digest challenges of WWW-Authenticate headers, SHA-256 is preferred if there are many of them.
+func parseDigestChallenges(headers []string) *digestChallenge {
+	var challenge *digestChallenge
+
+	for _, header := range headers {
+		header = strings.TrimSpace(header)
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Digest ") {
+			continue
+		}
+
+		params := parseAuthParams(header[7:])
+		c := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+			stale:     strings.EqualFold(params["stale"], "true"),
+		}
+
+		// prefer qop=auth, then auth-int
+		if qop, ok := params["qop"]; ok {
+			for _, q := range strings.Split(qop, ",") {
+				q = strings.TrimSpace(q)
+				if q == "auth" {
+					c.qop = q
+					break
+				}
+				if q == "auth-int" {
+					c.qop = q
+				}
+			}
+
+			// none of the qop supported
+			if c.qop == "" {
+				continue
+			}
+		}
+
+		if challenge == nil || strings.HasPrefix(strings.ToUpper(c.algorithm), "SHA-256") {
+			challenge = c
+		}
+	}
+
+	return challenge
+}
+
+// Parse the auth params, such as: realm="test", qop="auth,auth-int", algorithm=MD5
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " ")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			// quoted string, the backslash escapes the next character
+			var buf strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				buf.WriteByte(s[j])
+			}
+			value = buf.String()
+			if j < len(s) {
+				j++
+			}
+			s = s[j:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value = strings.TrimSpace(s[:j])
+			s = s[j:]
+		}
+
+		params[key] = value
+	}
+
+	return params
+}
@@ -0,0 +1,25 @@
+package error
+
+import "fmt"
+
+// The reasons of bulkhead rejection
+const (
+	// The wait queue is full
+	BulkheadQueueFull = "queue_full"
+	// The request waited in queue longer than the queue timeout
+	BulkheadQueueTimeout = "queue_timeout"
+)
+
+// BulkheadError is returned by the bulkhead middleware when the request is rejected before it is sent.
+type BulkheadError struct {
+	Key    string
+	Reason string
+}
+
+func (e *BulkheadError) Error() string {
+	return fmt.Sprintf("bulkhead of %s rejected the request: %s", e.Key, e.Reason)
+}
+
+func (e *BulkheadError) Temporary() bool {
+	return true
+}
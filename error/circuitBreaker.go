@@ -0,0 +1,28 @@
+package error
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCircuitOpen is the cause of every *CircuitOpenError.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned by the circuit breaker middleware when the request is rejected,
+// because the circuit of key is open, or the probes of half-open circuit are in flight.
+type CircuitOpenError struct {
+	Key string
+	// The state of circuit, open or half_open
+	State string
+	// The time to wait before the circuit turns half-open, 0 if it is half-open
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is %s, retry after %s", e.Key, e.State, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
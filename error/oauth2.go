@@ -0,0 +1,25 @@
+package error
+
+import "fmt"
+
+// OAuth2Error is returned when the token endpoint responds an error, see RFC 6749 section 5.2
+type OAuth2Error struct {
+	StatusCode       int
+	ErrorCode        string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	ErrorUri         string `json:"error_uri"`
+	// The raw response body
+	Body string `json:"-"`
+}
+
+func (e *OAuth2Error) Error() string {
+	if e.ErrorCode == "" {
+		return fmt.Sprintf("oauth2: cannot fetch token: %d, response: %s", e.StatusCode, e.Body)
+	}
+
+	if e.ErrorDescription == "" {
+		return fmt.Sprintf("oauth2: cannot fetch token: %d %s", e.StatusCode, e.ErrorCode)
+	}
+
+	return fmt.Sprintf("oauth2: cannot fetch token: %d %s: %s", e.StatusCode, e.ErrorCode, e.ErrorDescription)
+}
@@ -0,0 +1,18 @@
+package error
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PinningError is returned when none of the public keys of server certificates matches the pins.
+type PinningError struct {
+	// The excepted pins, such as sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+	Pins []string
+	// The pins of the public keys presented by server
+	PeerPins []string
+}
+
+func (e *PinningError) Error() string {
+	return fmt.Sprintf("certificate pinning failure: peer pins [%s] not match [%s]", strings.Join(e.PeerPins, ", "), strings.Join(e.Pins, ", "))
+}
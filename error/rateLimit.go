@@ -0,0 +1,21 @@
+package error
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateLimitError is returned by the fail fast rate limit middleware when the limit of key is exceeded.
+type RateLimitError struct {
+	Key string
+	// The time to wait for the next request
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %s exceeded, retry after %s", e.Key, e.RetryAfter)
+}
+
+func (e *RateLimitError) Temporary() bool {
+	return true
+}
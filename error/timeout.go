@@ -0,0 +1,41 @@
+package error
+
+import "fmt"
+
+// The phases of a request in which a timeout can occur.
+const (
+	// Waiting for a connection, including DNS lookup and TCP connect.
+	TimeoutPhaseDial = "dial"
+	// Performing the TLS handshake with the server.
+	TimeoutPhaseTlsHandshake = "tls_handshake"
+	// Writing the request headers and body to the connection.
+	TimeoutPhaseWriteRequest = "write_request"
+	// The request is sent, waiting for the response headers.
+	TimeoutPhaseResponseHeader = "response_header"
+	// Reading the response body.
+	TimeoutPhaseResponseBody = "response_body"
+)
+
+// TimeoutError is returned when a request timed out,
+// Phase tells in which phase of the request the timeout happened,
+// so a connect timeout can be told from a slow server.
+type TimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout: %s", e.Phase, e.Err)
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
@@ -2,4 +2,8 @@ module github.com/charleslxh/isuperagent
 
 go 1.12
 
-require github.com/stretchr/testify v1.4.0
+require (
+	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20200115085410-6d4e4cb37c7d
+	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
+)
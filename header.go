@@ -1,6 +1,7 @@
 package isuperagent
 
 import (
+	"net/http"
 	"regexp"
 	"strings"
 )
@@ -51,3 +52,18 @@ func (c *ContentType) String() string {
 
 	return buf.String()
 }
+
+// Copy the headers, the values of copy can be changed without affecting the origin headers.
+// It is the same as http.Header.Clone of Go 1.13, nil if the headers are nil.
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+
+	c := make(http.Header, len(h))
+	for name, values := range h {
+		c[name] = append([]string(nil), values...)
+	}
+
+	return c
+}
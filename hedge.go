@@ -0,0 +1,281 @@
+package isuperagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The defaults of hedge middleware
+const (
+	DefaultHedgeMaxAttempts = 2
+	DefaultHedgeMinSamples  = 20
+)
+
+// The latencies kept to learn the delay
+const hedgeLatencySamples = 100
+
+type HedgeConfig struct {
+	// The delay before sending the next request, it is used until MinSamples latencies are collected if Percentile is set
+	Delay time.Duration
+	// Learn the delay from the latencies of key, such as 0.95 is the p95 latency, 0 is disabled
+	Percentile float64
+	// The latencies needed to learn the delay, default is DefaultHedgeMinSamples
+	MinSamples int
+	// The max requests sent, include the original one, default is DefaultHedgeMaxAttempts
+	MaxAttempts int
+	// The idempotent methods to hedge, default is GET, HEAD and OPTIONS
+	Methods []string
+	// The key of latencies, default is KeyByHost
+	Key KeyFunc
+}
+
+type hedgeLatencies struct {
+	samples []time.Duration
+	next    int
+}
+
+type hedger struct {
+	config  HedgeConfig
+	methods map[string]bool
+
+	mu        sync.Mutex
+	latencies map[string]*hedgeLatencies
+}
+
+type hedgeResult struct {
+	attempt int
+	res     Response
+	err     error
+	latency time.Duration
+}
+
+type hedgeAttemptKey struct{}
+
+type hedgeWinnerKey struct{}
+
+// Middleware: request hedging
+//
+// Send a copy of request if the response does not arrive after the delay, then return the first successful response
+// and cancel the others, so the slow replica does not slow down the request.
+// The copies are sent by the downstream middlewares only, the upstream middlewares are not called again,
+// use GetHedgeAttempt to get the attempt won.
+// The middleware is created by a *HedgeConfig, such as:
+//
+//	isuperagent.NewMiddleware("hedge", &isuperagent.HedgeConfig{Delay: 100 * time.Millisecond, Percentile: 0.95})
+func NewHedgeMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.HedgeConfig")
+	}
+
+	var config HedgeConfig
+	switch c := v[0].(type) {
+	case *HedgeConfig:
+		config = *c
+	case HedgeConfig:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.HedgeConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.Delay <= 0 && config.Percentile <= 0 {
+		return nil, errors.New("excepted delay or percentile of hedge is greater than 0")
+	}
+	if config.Percentile > 1 {
+		return nil, errors.New(fmt.Sprintf("excepted percentile of hedge is not greater than 1, but got %v", config.Percentile))
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = DefaultHedgeMinSamples
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultHedgeMaxAttempts
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	if config.Key == nil {
+		config.Key = KeyByHost
+	}
+
+	h := &hedger{config: config, methods: map[string]bool{}, latencies: map[string]*hedgeLatencies{}}
+	for _, method := range config.Methods {
+		h.methods[method] = true
+	}
+
+	return h.middleware, nil
+}
+
+func (h *hedger) middleware(ctx Context, next Next) error {
+	r := ctx.GetReq()
+
+	// hedged by the upstream hedge middleware already, or the method is not idempotent
+	if r.GetContext().Value(hedgeAttemptKey{}) != nil || !h.methods[r.GetMethod()] || h.config.MaxAttempts < 2 {
+		return next()
+	}
+
+	key := h.config.Key(r)
+	delay := h.delay(key)
+	parent := r.GetContext()
+
+	// copy the request and context before they are changed by the downstream middlewares
+	downstream := getDownstream(ctx)
+	copies := make([]Context, h.config.MaxAttempts-1)
+	for i := range copies {
+		copies[i] = forkContext(ctx, r.Clone())
+	}
+
+	results := make(chan hedgeResult, h.config.MaxAttempts)
+	var cancels []context.CancelFunc
+
+	// the original request is sent by the downstream middlewares
+	attemptCtx, cancel := context.WithCancel(context.WithValue(parent, hedgeAttemptKey{}, 1))
+	cancels = append(cancels, cancel)
+	r.SetContext(attemptCtx)
+	start := time.Now()
+	go func() {
+		err := next()
+		results <- hedgeResult{attempt: 1, res: ctx.GetRes(), err: err, latency: time.Since(start)}
+	}()
+
+	// the copies are sent by the downstream middlewares
+	launch := func(attempt int) {
+		attemptCtx, cancel := context.WithCancel(context.WithValue(parent, hedgeAttemptKey{}, attempt))
+		cancels = append(cancels, cancel)
+		c := copies[attempt-2]
+		c.GetReq().SetContext(attemptCtx)
+		start := time.Now()
+		go func() {
+			err := Compose(c, downstream)()
+			results <- hedgeResult{attempt: attempt, res: c.GetRes(), err: err, latency: time.Since(start)}
+		}()
+	}
+
+	sent, running := 1, 1
+	timer := time.NewTimer(delay)
+	var winner, failure *hedgeResult
+	for running > 0 && winner == nil {
+		select {
+		case <-timer.C:
+			if sent < h.config.MaxAttempts {
+				sent++
+				running++
+				launch(sent)
+				timer.Reset(delay)
+			}
+		case result := <-results:
+			running--
+			if result.err == nil {
+				winner = &result
+				break
+			}
+			if failure == nil {
+				failure = &result
+			}
+			// send the next one at once if all of requests failed
+			if running == 0 && sent < h.config.MaxAttempts && parent.Err() == nil {
+				sent++
+				running++
+				launch(sent)
+				timer.Reset(delay)
+			}
+		}
+	}
+	timer.Stop()
+
+	// cancel the others and wait for them, so the context is not changed by them any more
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for ; running > 0; running-- {
+		<-results
+	}
+	r.SetContext(parent)
+
+	if winner == nil {
+		return failure.err
+	}
+
+	h.record(key, winner.latency)
+	ctx.SetRes(winner.res)
+	ctx.Set(hedgeWinnerKey{}, winner.attempt)
+
+	return nil
+}
+
+// The delay of key, it is learned from the latencies if there are enough samples.
+func (h *hedger) delay(key string) time.Duration {
+	if h.config.Percentile <= 0 {
+		return h.config.Delay
+	}
+
+	h.mu.Lock()
+	l, ok := h.latencies[key]
+	var samples []time.Duration
+	if ok && len(l.samples) >= h.config.MinSamples {
+		samples = append(samples, l.samples...)
+	}
+	h.mu.Unlock()
+
+	if len(samples) == 0 {
+		if h.config.Delay > 0 {
+			return h.config.Delay
+		}
+		// send the copy at once if there is no delay to use
+		return time.Nanosecond
+	}
+
+	sort.Slice(samples, func(i, k int) bool {
+		return samples[i] < samples[k]
+	})
+	i := int(math.Ceil(h.config.Percentile*float64(len(samples)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return samples[i]
+}
+
+func (h *hedger) record(key string, latency time.Duration) {
+	if h.config.Percentile <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.latencies[key]
+	if !ok {
+		l = &hedgeLatencies{}
+		h.latencies[key] = l
+	}
+
+	if len(l.samples) < hedgeLatencySamples {
+		l.samples = append(l.samples, latency)
+		return
+	}
+	l.samples[l.next] = latency
+	l.next = (l.next + 1) % hedgeLatencySamples
+}
+
+// Get the attempt of hedge middleware, 1 is the original request and 2 is the first copy.
+// It is the attempt won after the hedge middleware returns, or the attempt of request in the downstream middlewares,
+// 0 if the request is not hedged.
+func GetHedgeAttempt(ctx Context) int {
+	if attempt, ok := ctx.Get(hedgeWinnerKey{}).(int); ok {
+		return attempt
+	}
+	if attempt, ok := ctx.Get(hedgeAttemptKey{}).(int); ok {
+		return attempt
+	}
+	if attempt, ok := ctx.GetReq().GetContext().Value(hedgeAttemptKey{}).(int); ok {
+		return attempt
+	}
+
+	return 0
+}
@@ -0,0 +1,301 @@
+package isuperagent
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The components of canonical string of hmac_sign middleware
+const (
+	HmacSignMethod    = "method"
+	HmacSignHost      = "host"
+	HmacSignPath      = "path"
+	HmacSignQuery     = "query"
+	HmacSignBodyHash  = "body_hash"
+	HmacSignTimestamp = "timestamp"
+	HmacSignNonce     = "nonce"
+	// The value of request header, such as header:Content-Type
+	HmacSignHeaderPrefix = "header:"
+)
+
+// The hash algorithms of hmac_sign middleware
+const (
+	HmacSha1   = "sha1"
+	HmacSha256 = "sha256"
+	HmacSha512 = "sha512"
+)
+
+// The encodings of signature
+const (
+	HmacEncodingHex    = "hex"
+	HmacEncodingBase64 = "base64"
+)
+
+// The formats of timestamp, other values are used as the layout of time.Format
+const (
+	HmacTimestampUnix      = "unix"
+	HmacTimestampUnixMilli = "unix_ms"
+)
+
+type HmacSignConfig struct {
+	// The secret key of hmac
+	Secret string
+	// The components of canonical string in order, default is method, path, query, body_hash, timestamp and nonce
+	Components []string
+	// The separator of components, default is "\n"
+	Separator string
+	// The hash algorithm, sha1, sha256 or sha512, default is sha256.
+	// The body hash is computed by the same algorithm.
+	Hash string
+	// The encoding of signature and body hash, hex or base64, default is hex
+	Encoding string
+	// Where to send the signature, timestamp and nonce, "header" or "query", default is header.
+	// In query mode, the query component always contains the timestamp and nonce, but not the signature,
+	// no matter where the query is in the components.
+	In string
+	// The name of signature header or query parameter, default is X-Signature
+	Name string
+	// The prefix of signature value, such as "HMAC-SHA256 "
+	Prefix string
+	// The name of timestamp, default is X-Timestamp, it is sent if timestamp is one of components
+	TimestampName string
+	// The format of timestamp, default is unix
+	TimestampFormat string
+	// The name of nonce, default is X-Nonce, it is sent if nonce is one of components
+	NonceName string
+}
+
+// Middleware: HMAC request signing
+//
+// Sign the canonical string composed by the components of request, such as:
+//
+//	isuperagent.NewMiddleware("hmac_sign", &isuperagent.HmacSignConfig{
+//		Secret:     "secret",
+//		Components: []string{isuperagent.HmacSignMethod, isuperagent.HmacSignPath, isuperagent.HmacSignTimestamp},
+//		Name:       "X-Signature",
+//	})
+//
+// The request is signed right before it is sent, the body hash is computed from the raw body of GetBodyRaw,
+// so the signature matches what is sent after all of middlewares changed the request.
+func NewHmacSignMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.HmacSignConfig")
+	}
+
+	var config HmacSignConfig
+	switch c := v[0].(type) {
+	case *HmacSignConfig:
+		config = *c
+	case HmacSignConfig:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.HmacSignConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.Secret == "" {
+		return nil, errors.New("hmac secret is required")
+	}
+	if len(config.Components) == 0 {
+		config.Components = []string{HmacSignMethod, HmacSignPath, HmacSignQuery, HmacSignBodyHash, HmacSignTimestamp, HmacSignNonce}
+	}
+	if config.Separator == "" {
+		config.Separator = "\n"
+	}
+	if config.Hash == "" {
+		config.Hash = HmacSha256
+	}
+	if config.Encoding == "" {
+		config.Encoding = HmacEncodingHex
+	}
+	if config.In == "" {
+		config.In = ApiKeyInHeader
+	}
+	if config.Name == "" {
+		config.Name = "X-Signature"
+	}
+	if config.TimestampName == "" {
+		config.TimestampName = "X-Timestamp"
+	}
+	if config.TimestampFormat == "" {
+		config.TimestampFormat = HmacTimestampUnix
+	}
+	if config.NonceName == "" {
+		config.NonceName = "X-Nonce"
+	}
+
+	newHash, err := hmacHashFunc(config.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if config.Encoding != HmacEncodingHex && config.Encoding != HmacEncodingBase64 {
+		return nil, errors.New(fmt.Sprintf("unsupported hmac encoding %s", config.Encoding))
+	}
+	if config.In != ApiKeyInHeader && config.In != ApiKeyInQuery {
+		return nil, errors.New(fmt.Sprintf("excepted hmac signature is in header or query, but got %s", config.In))
+	}
+	for _, component := range config.Components {
+		switch component {
+		case HmacSignMethod, HmacSignHost, HmacSignPath, HmacSignQuery, HmacSignBodyHash, HmacSignTimestamp, HmacSignNonce:
+		default:
+			if !strings.HasPrefix(component, HmacSignHeaderPrefix) {
+				return nil, errors.New(fmt.Sprintf("unsupported hmac component %s", component))
+			}
+		}
+	}
+
+	s := &hmacSigner{config: config, newHash: newHash}
+
+	return func(ctx Context, next Next) error {
+		AddSignFunc(ctx, func(req *http.Request, body []byte) error {
+			return s.sign(req, body, time.Now())
+		})
+
+		return next()
+	}, nil
+}
+
+type hmacSigner struct {
+	config  HmacSignConfig
+	newHash func() hash.Hash
+}
+
+func (s *hmacSigner) sign(req *http.Request, body []byte, now time.Time) error {
+	c := s.config
+
+	// set the timestamp and nonce firstly, so the query is the same as what is sent
+	var timestamp, nonce string
+	for _, component := range c.Components {
+		switch component {
+		case HmacSignTimestamp:
+			timestamp = hmacTimestamp(now, c.TimestampFormat)
+			s.set(req, c.TimestampName, timestamp)
+		case HmacSignNonce:
+			var err error
+			if nonce, err = newCnonce(); err != nil {
+				return err
+			}
+			s.set(req, c.NonceName, nonce)
+		}
+	}
+
+	values := make([]string, 0, len(c.Components))
+	for _, component := range c.Components {
+		var value string
+
+		switch component {
+		case HmacSignMethod:
+			value = req.Method
+		case HmacSignHost:
+			value = requestHost(req)
+		case HmacSignPath:
+			value = req.URL.EscapedPath()
+			if value == "" {
+				value = "/"
+			}
+		case HmacSignQuery:
+			// the query is sorted, the signature is not signed
+			query := req.URL.Query()
+			if c.In == ApiKeyInQuery {
+				query.Del(c.Name)
+			}
+			value = sortedQuery(query)
+		case HmacSignBodyHash:
+			h := s.newHash()
+			h.Write(body)
+			value = s.encode(h.Sum(nil))
+		case HmacSignTimestamp:
+			value = timestamp
+		case HmacSignNonce:
+			value = nonce
+		default:
+			value = req.Header.Get(strings.TrimPrefix(component, HmacSignHeaderPrefix))
+		}
+
+		values = append(values, value)
+	}
+
+	mac := hmac.New(s.newHash, []byte(c.Secret))
+	mac.Write([]byte(strings.Join(values, c.Separator)))
+	s.set(req, c.Name, c.Prefix+s.encode(mac.Sum(nil)))
+
+	return nil
+}
+
+// Set the header or query parameter of request.
+func (s *hmacSigner) set(req *http.Request, name, value string) {
+	if s.config.In == ApiKeyInHeader {
+		req.Header.Set(name, value)
+		return
+	}
+
+	query := req.URL.Query()
+	query.Set(name, value)
+	req.URL.RawQuery = query.Encode()
+}
+
+func (s *hmacSigner) encode(sum []byte) string {
+	if s.config.Encoding == HmacEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(sum)
+	}
+
+	return hex.EncodeToString(sum)
+}
+
+func hmacHashFunc(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case HmacSha1:
+		return sha1.New, nil
+	case HmacSha256:
+		return sha256.New, nil
+	case HmacSha512:
+		return sha512.New, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported hmac hash %s", name))
+	}
+}
+
+func hmacTimestamp(now time.Time, format string) string {
+	switch format {
+	case HmacTimestampUnix:
+		return strconv.FormatInt(now.Unix(), 10)
+	case HmacTimestampUnixMilli:
+		return strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	default:
+		return now.UTC().Format(format)
+	}
+}
+
+// Encode the query sorted by name then value.
+func sortedQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+
+		for _, v := range values {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(v))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,102 @@
+package isuperagent
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// The default header of idempotency key
+const DefaultIdempotencyKeyHeader = "Idempotency-Key"
+
+type IdempotencyKeyConfig struct {
+	// The header of key, default is DefaultIdempotencyKeyHeader
+	Header string
+	// The methods to set the key, default is POST and PATCH
+	Methods []string
+	// Generate the key, default is NewUUID
+	Generator func() (string, error)
+}
+
+type idempotencyKey struct{}
+
+// Middleware: idempotency key
+//
+// Generate a key for every request, and send it in the Idempotency-Key header,
+// so the server can tell the retries of request from the new requests.
+// The key is generated once for a Do, the retries of request are sent with the same key,
+// the key set by the request already is kept. Use GetIdempotencyKey to get the key.
+// The middleware is created by an optional *IdempotencyKeyConfig, such as:
+//
+//	isuperagent.NewMiddleware("idempotency_key", &isuperagent.IdempotencyKeyConfig{Header: "X-Request-Id"})
+func NewIdempotencyKeyMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	var config IdempotencyKeyConfig
+	if len(v) > 0 {
+		switch c := v[0].(type) {
+		case *IdempotencyKeyConfig:
+			config = *c
+		case IdempotencyKeyConfig:
+			config = c
+		default:
+			return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.IdempotencyKeyConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+		}
+	}
+
+	if config.Header == "" {
+		config.Header = DefaultIdempotencyKeyHeader
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	if config.Generator == nil {
+		config.Generator = NewUUID
+	}
+
+	methods := map[string]bool{}
+	for _, method := range config.Methods {
+		methods[method] = true
+	}
+
+	return func(ctx Context, next Next) error {
+		r := ctx.GetReq()
+		if !methods[r.GetMethod()] {
+			return next()
+		}
+
+		key := r.GetHeader(config.Header)
+		if key == "" {
+			var err error
+			if key, err = config.Generator(); err != nil {
+				return err
+			}
+
+			// the key belongs to this Do, the request sent again gets a new key
+			r.GetHeaders().Set(config.Header, key)
+			defer r.GetHeaders().Del(config.Header)
+		}
+		ctx.Set(idempotencyKey{}, key)
+
+		return next()
+	}, nil
+}
+
+// Get the idempotency key of request, it is empty if the idempotency_key middleware does not set it.
+func GetIdempotencyKey(ctx Context) string {
+	key, _ := ctx.Get(idempotencyKey{}).(string)
+
+	return key
+}
+
+// Generate a random UUID of version 4, see RFC 4122
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
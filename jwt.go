@@ -0,0 +1,308 @@
+package isuperagent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The signing algorithms of jwt middleware
+const (
+	JwtHS256 = "HS256"
+	JwtRS256 = "RS256"
+	JwtES256 = "ES256"
+	JwtEdDSA = "EdDSA"
+)
+
+// The default lifetime of token
+const DefaultJwtTTL = 5 * time.Minute
+
+// The default time to mint a new token before it expires
+const DefaultJwtExpiryDelta = 30 * time.Second
+
+type JwtConfig struct {
+	// One of HS256, RS256, ES256 and EdDSA, default is HS256
+	Algorithm string
+	// The signing key.
+	// HS256 uses the secret of []byte or string,
+	// RS256, ES256 and EdDSA use *rsa.PrivateKey, *ecdsa.PrivateKey and ed25519.PrivateKey,
+	// or the private key in PEM format, the EdDSA key in PEM format requires Go 1.13 or later.
+	Key interface{}
+	// The key id of token header
+	KeyId string
+	// The claims iss and sub
+	Issuer  string
+	Subject string
+	// The claim aud, default is the scheme and host of request url, such as https://api.example.com
+	Audience string
+	// The lifetime of token, default is DefaultJwtTTL
+	TTL time.Duration
+	// Mint a new token this long before it expires, default is DefaultJwtExpiryDelta,
+	// it is half of TTL if it is not less than TTL.
+	ExpiryDelta time.Duration
+	// The extra claims
+	Claims map[string]interface{}
+}
+
+type jwtToken struct {
+	token  string
+	expiry time.Time
+}
+
+type jwtSigner struct {
+	config JwtConfig
+	key    interface{}
+
+	mu     sync.Mutex
+	tokens map[string]*jwtToken
+}
+
+// Middleware: JWT authorization
+//
+// Mint a short-lived JWT with the claims iss, sub, aud, iat, exp and jti, then send it as bearer token.
+// The token is cached per audience until it is about to expire.
+// The middleware is created by a *JwtConfig, such as:
+//
+//	isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{Algorithm: isuperagent.JwtRS256, Key: privateKeyPem, Issuer: "service-a"})
+func NewJwtMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.JwtConfig")
+	}
+
+	var config JwtConfig
+	switch c := v[0].(type) {
+	case *JwtConfig:
+		config = *c
+	case JwtConfig:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.JwtConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.Algorithm == "" {
+		config.Algorithm = JwtHS256
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultJwtTTL
+	}
+	if config.ExpiryDelta <= 0 {
+		config.ExpiryDelta = DefaultJwtExpiryDelta
+	}
+	if config.ExpiryDelta >= config.TTL {
+		config.ExpiryDelta = config.TTL / 2
+	}
+
+	key, err := parseJwtKey(config.Algorithm, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &jwtSigner{config: config, key: key, tokens: map[string]*jwtToken{}}
+
+	return func(ctx Context, next Next) error {
+		r := ctx.GetReq()
+
+		audience := config.Audience
+		if audience == "" {
+			audience = r.GetUrl().Scheme + "://" + r.GetUrl().Host
+		}
+
+		token, err := s.Token(audience)
+		if err != nil {
+			return err
+		}
+
+		AddSecrets(ctx, token)
+		r.GetHeaders().Set("Authorization", "Bearer "+token)
+
+		return next()
+	}, nil
+}
+
+// Get the cached token of audience, or mint a new one if it is about to expire.
+func (s *jwtSigner) Token(audience string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if t, ok := s.tokens[audience]; ok && now.Add(s.config.ExpiryDelta).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	t, err := s.mint(audience, now)
+	if err != nil {
+		return "", err
+	}
+	s.tokens[audience] = t
+
+	return t.token, nil
+}
+
+func (s *jwtSigner) mint(audience string, now time.Time) (*jwtToken, error) {
+	c := s.config
+	expiry := now.Add(c.TTL)
+
+	jti, err := newCnonce()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	for k, v := range c.Claims {
+		claims[k] = v
+	}
+	if c.Issuer != "" {
+		claims["iss"] = c.Issuer
+	}
+	if c.Subject != "" {
+		claims["sub"] = c.Subject
+	}
+	claims["aud"] = audience
+	claims["iat"] = now.Unix()
+	claims["exp"] = expiry.Unix()
+	claims["jti"] = jti
+
+	header := map[string]string{"alg": c.Algorithm, "typ": "JWT"}
+	if c.KeyId != "" {
+		header["kid"] = c.KeyId
+	}
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	signature, err := s.sign([]byte(signingInput))
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtToken{
+		token:  signingInput + "." + base64.RawURLEncoding.EncodeToString(signature),
+		expiry: expiry,
+	}, nil
+}
+
+func (s *jwtSigner) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+
+	switch key := s.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// the signature is the concatenation of r and s in 32 bytes, see RFC 7518 section 3.4
+		signature := make([]byte, 64)
+		rb, sb := r.Bytes(), ss.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+		return signature, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported jwt key %s", reflect.TypeOf(s.key)))
+	}
+}
+
+// Parse the key of algorithm, the private key may be in PEM format.
+func parseJwtKey(algorithm string, key interface{}) (interface{}, error) {
+	if algorithm == JwtHS256 {
+		switch k := key.(type) {
+		case []byte:
+			if len(k) > 0 {
+				return k, nil
+			}
+		case string:
+			if k != "" {
+				return []byte(k), nil
+			}
+		}
+
+		return nil, errors.New(fmt.Sprintf("excepted HS256 key is non-empty []byte or string, but got %v(%s)", key, reflect.TypeOf(key)))
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		parsed, err := ParsePrivateKeyPem(k)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	case string:
+		parsed, err := ParsePrivateKeyPem([]byte(k))
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	}
+
+	var ok bool
+	switch algorithm {
+	case JwtRS256:
+		_, ok = key.(*rsa.PrivateKey)
+	case JwtES256:
+		var k *ecdsa.PrivateKey
+		if k, ok = key.(*ecdsa.PrivateKey); ok && k.Curve.Params().BitSize != 256 {
+			return nil, errors.New("ES256 requires the key of P-256 curve")
+		}
+	case JwtEdDSA:
+		_, ok = key.(ed25519.PrivateKey)
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported jwt algorithm %s", algorithm))
+	}
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("excepted the private key of %s, but got %s", algorithm, reflect.TypeOf(key)))
+	}
+
+	return key, nil
+}
+
+// Parse the private key in PEM format, PKCS#8, PKCS#1 and EC private keys are supported.
+func ParsePrivateKeyPem(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New(fmt.Sprintf("unsupported private key %s", reflect.TypeOf(key)))
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("failed to parse private key of PEM block %s", block.Type))
+}
@@ -0,0 +1,325 @@
+package isuperagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The events of logger middleware
+const (
+	// The request is about to be sent
+	LogEventRequest = "request"
+	// The response is received, or the request failed
+	LogEventResponse = "response"
+)
+
+// The headers redacted by default
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// The structured event of logger middleware.
+type LogEvent struct {
+	// The event, request or response
+	Event  string
+	Method string
+	// The url with queries, the secrets are redacted
+	Url string
+	// The headers of request or response, nil if the headers are not logged
+	Headers http.Header
+	// The body of request or response, it is truncated to MaxBodySize, empty if the body is not logged
+	Body string
+	// The size of body in bytes
+	Size int
+	// The status code and the time spent of response event
+	StatusCode int
+	Duration   time.Duration
+	// The times the request is sent, include the retries
+	Attempt int
+	// The error of failed request
+	Error error
+}
+
+// Format the event in logfmt, such as: event=response method=GET url=http://localhost/ status=200 duration=2ms
+func (e LogEvent) String() string {
+	var buf bytes.Buffer
+	write := func(k, v string) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+
+	write("event", e.Event)
+	write("method", e.Method)
+	write("url", e.Url)
+	if e.Event == LogEventResponse {
+		if e.StatusCode != 0 {
+			write("status", strconv.Itoa(e.StatusCode))
+		}
+		write("duration", e.Duration.String())
+		write("attempt", strconv.Itoa(e.Attempt))
+	}
+	write("size", strconv.Itoa(e.Size))
+	if e.Error != nil {
+		write("error", e.Error.Error())
+	}
+
+	names := make([]string, 0, len(e.Headers))
+	for name := range e.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write("header."+name, strings.Join(e.Headers[name], ", "))
+	}
+	if e.Body != "" {
+		write("body", e.Body)
+	}
+
+	return buf.String()
+}
+
+// Logger writes the events of logger middleware.
+type Logger interface {
+	Log(event LogEvent)
+}
+
+// The function to write the events.
+type LoggerFunc func(event LogEvent)
+
+func (f LoggerFunc) Log(event LogEvent) {
+	f(event)
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+// The logger writes the events in logfmt by the log package, the logger writes to stderr if l is nil.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	return &stdLogger{l: l}
+}
+
+func (l *stdLogger) Log(event LogEvent) {
+	l.l.Println(event.String())
+}
+
+type LoggerConfig struct {
+	// The logger, default is NewStdLogger(nil)
+	Logger Logger
+	// Log the headers of request and response
+	Headers bool
+	// Log the body truncated to the bytes, 0 is not logged
+	MaxBodySize int
+	// The headers redacted, default is DefaultRedactHeaders
+	RedactHeaders []string
+	// The queries redacted, such as access_token
+	RedactQueries []string
+	// The fields of JSON body redacted at any depth, such as password
+	RedactJsonFields []string
+}
+
+type requestLogger struct {
+	config        LoggerConfig
+	redactHeaders map[string]bool
+	redactQueries map[string]bool
+	redactFields  map[string]bool
+}
+
+// Middleware: structured logging
+//
+// Log the request before it is sent and the response after it is received, see LogEvent.
+// The headers, queries and JSON fields configured are redacted, so are the secrets of auth middlewares,
+// the secrets of request event are redacted only if the logger middleware is after the auth middlewares.
+// The middleware is created by an optional *LoggerConfig, such as:
+//
+//	isuperagent.NewMiddleware("logger", &isuperagent.LoggerConfig{MaxBodySize: 1024, RedactJsonFields: []string{"password"}})
+func NewLoggerMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	var config LoggerConfig
+	if len(v) > 0 {
+		switch c := v[0].(type) {
+		case *LoggerConfig:
+			config = *c
+		case LoggerConfig:
+			config = c
+		default:
+			return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.LoggerConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+		}
+	}
+
+	if config.Logger == nil {
+		config.Logger = NewStdLogger(nil)
+	}
+	if config.RedactHeaders == nil {
+		config.RedactHeaders = DefaultRedactHeaders
+	}
+
+	l := &requestLogger{config: config, redactHeaders: map[string]bool{}, redactQueries: map[string]bool{}, redactFields: map[string]bool{}}
+	for _, name := range config.RedactHeaders {
+		l.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range config.RedactQueries {
+		l.redactQueries[name] = true
+	}
+	for _, name := range config.RedactJsonFields {
+		l.redactFields[strings.ToLower(name)] = true
+	}
+
+	return l.middleware, nil
+}
+
+func (l *requestLogger) middleware(ctx Context, next Next) error {
+	r := ctx.GetReq()
+
+	event := LogEvent{Event: LogEventRequest, Method: r.GetMethod(), Url: l.url(ctx)}
+	if l.config.Headers {
+		event.Headers = l.headers(ctx, r.GetHeaders())
+	}
+	if body, err := r.GetBodyRaw(); err == nil {
+		event.Size = len(body)
+		event.Body = l.body(ctx, body)
+	}
+	l.config.Logger.Log(event)
+
+	start := time.Now()
+	err := next()
+
+	event = LogEvent{
+		Event:    LogEventResponse,
+		Method:   r.GetMethod(),
+		Url:      l.url(ctx),
+		Duration: time.Since(start),
+		Attempt:  GetAttempts(ctx),
+		Error:    l.err(ctx, err),
+	}
+	if res := ctx.GetRes(); err == nil && res != nil {
+		event.StatusCode = res.GetStatusCode()
+		if l.config.Headers {
+			event.Headers = l.headers(ctx, res.GetHeaders())
+		}
+		if res.GetBody() != nil {
+			event.Size = len(res.GetBody().GetData())
+			event.Body = l.body(ctx, res.GetBody().GetData())
+		}
+	}
+	l.config.Logger.Log(event)
+
+	return err
+}
+
+// The url of request with the queries and secrets redacted.
+func (l *requestLogger) url(ctx Context) string {
+	return l.redactUrl(ctx, ctx.GetReq().GetRawUrl())
+}
+
+func (l *requestLogger) redactUrl(ctx Context, raw string) string {
+	if len(l.redactQueries) > 0 {
+		if u, err := url.Parse(raw); err == nil {
+			// rebuild the raw query instead of encoding it, so the placeholder is not escaped
+			pairs := strings.Split(u.RawQuery, "&")
+			for i, pair := range pairs {
+				name := strings.SplitN(pair, "=", 2)[0]
+				if unescaped, err := url.QueryUnescape(name); err == nil && l.redactQueries[unescaped] {
+					pairs[i] = name + "=" + RedactedPlaceholder
+				}
+			}
+			u.RawQuery = strings.Join(pairs, "&")
+			raw = u.String()
+		}
+	}
+
+	return Redact(ctx, raw)
+}
+
+// The error with the url and secrets redacted, the *url.Error of http.Client contains the full url.
+func (l *requestLogger) err(ctx Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*url.Error); ok {
+		redacted := *e
+		redacted.URL = l.redactUrl(ctx, e.URL)
+		err = &redacted
+	}
+	if text := Redact(ctx, err.Error()); text != err.Error() {
+		return errors.New(text)
+	}
+
+	return err
+}
+
+func (l *requestLogger) headers(ctx Context, headers http.Header) http.Header {
+	redacted := http.Header{}
+	for name, vs := range headers {
+		for _, v := range vs {
+			if l.redactHeaders[name] {
+				v = RedactedPlaceholder
+			}
+			redacted.Add(name, Redact(ctx, v))
+		}
+	}
+
+	return redacted
+}
+
+// The body with the JSON fields and secrets redacted, it is truncated to MaxBodySize.
+func (l *requestLogger) body(ctx Context, data []byte) string {
+	if l.config.MaxBodySize <= 0 || len(data) == 0 {
+		return ""
+	}
+
+	if len(l.redactFields) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err == nil {
+			if redacted, err := json.Marshal(l.redactJson(v)); err == nil {
+				data = redacted
+			}
+		}
+	}
+
+	body := Redact(ctx, string(data))
+	if len(body) > l.config.MaxBodySize {
+		body = body[:l.config.MaxBodySize] + "..."
+	}
+
+	return body
+}
+
+func (l *requestLogger) redactJson(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if l.redactFields[strings.ToLower(k)] {
+				value[k] = RedactedPlaceholder
+			} else {
+				value[k] = l.redactJson(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = l.redactJson(item)
+		}
+	}
+
+	return v
+}
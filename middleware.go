@@ -2,15 +2,12 @@ package isuperagent
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"reflect"
-	"strings"
 	"time"
 )
 
@@ -39,27 +36,51 @@ func RegisterMiddlewareFactory(name string, factory MiddlewareFactory) {
 
 // Composer all middleware
 // Return the start middleware
+// The next() can be called more than once, such as re-send the request after authorization,
+// the downstream middlewares are invoked again each time.
+// The sign functions added by the downstream middlewares are dropped after next() returns,
+// so they are not added twice when next() is called again.
 func Compose(ctx Context, middleware []Middleware) func() error {
-	i := 0
-	var next Next
-	next = func() error {
-		i++
-		if i >= len(middleware) {
+	var dispatch func(i int) error
+	dispatch = func(i int) error {
+		if i >= len(middleware) || middleware[i] == nil {
 			return nil
 		}
 
-		if middleware[i] == nil {
-			return nil
-		}
+		// the middleware may send a copy of request by the downstream middlewares, such as hedge
+		ctx.Set(downstreamKey{}, middleware[i+1:])
+
+		return middleware[i](ctx, func() error {
+			signs := GetSignFuncs(ctx)
+			defer ctx.Set(signFuncsKey{}, signs)
 
-		return middleware[i](ctx, next)
+			return dispatch(i + 1)
+		})
 	}
 
 	return func() error {
-		return middleware[i](ctx, next)
+		return dispatch(0)
 	}
 }
 
+type downstreamKey struct{}
+
+// Get the downstream middlewares of the middleware being called, it must be called before next().
+func getDownstream(ctx Context) []Middleware {
+	middleware, _ := ctx.Get(downstreamKey{}).([]Middleware)
+
+	return middleware
+}
+
+// Create the context of a copy of request, the values of ctx set by now are shared with the copy.
+func forkContext(ctx Context, req Request) Context {
+	if ic, ok := ctx.(*icontext); ok {
+		return NewContext(ic.Context, req, nil)
+	}
+
+	return NewContext(req.GetContext(), req, nil)
+}
+
 // The factory method to create a new middleware
 // tip: you must register your middleware firstly by invoke isuperagent.RegisterMiddleware() method
 func NewMiddleware(name string, v ...interface{}) (Middleware, error) {
@@ -78,9 +99,57 @@ func init() {
 	RegisterMiddlewareFactory("request_time", NewTimeMiddlewareFactory)
 	RegisterMiddlewareFactory("debug", NewDebugMiddlewareFactory)
 	RegisterMiddlewareFactory("basic_auth", NewBasicAuthMiddlewareFactory)
+	RegisterMiddlewareFactory("digest_auth", NewDigestAuthMiddlewareFactory)
+	RegisterMiddlewareFactory("oauth2", NewOAuth2MiddlewareFactory)
+	RegisterMiddlewareFactory("bearer", NewBearerMiddlewareFactory)
+	RegisterMiddlewareFactory("api_key", NewApiKeyMiddlewareFactory)
+	RegisterMiddlewareFactory("sigv4", NewSigV4MiddlewareFactory)
+	RegisterMiddlewareFactory("hmac_sign", NewHmacSignMiddlewareFactory)
+	RegisterMiddlewareFactory("jwt", NewJwtMiddlewareFactory)
+	RegisterMiddlewareFactory("cache", NewCacheMiddlewareFactory)
+	RegisterMiddlewareFactory("rate_limit", NewRateLimitMiddlewareFactory)
+	RegisterMiddlewareFactory("circuit_breaker", NewCircuitBreakerMiddlewareFactory)
+	RegisterMiddlewareFactory("bulkhead", NewBulkheadMiddlewareFactory)
+	RegisterMiddlewareFactory("hedge", NewHedgeMiddlewareFactory)
+	RegisterMiddlewareFactory("singleflight", NewSingleFlightMiddlewareFactory)
+	RegisterMiddlewareFactory("idempotency_key", NewIdempotencyKeyMiddlewareFactory)
+	RegisterMiddlewareFactory("logger", NewLoggerMiddlewareFactory)
 	RegisterMiddlewareFactory("request_exec", NewRequestExecMiddlewareFactory)
 }
 
+type attemptsKey struct{}
+
+// Get the times the request is sent by the request_exec middleware, include the retries,
+// it is 0 before the request is sent.
+func GetAttempts(ctx Context) int {
+	attempts, _ := ctx.Get(attemptsKey{}).(int)
+
+	return attempts
+}
+
+// SignFunc signs the http.Request right before it is sent, the body is the raw request body.
+// It is called for every attempt of retry, so the signature is always fresh.
+type SignFunc func(req *http.Request, body []byte) error
+
+type signFuncsKey struct{}
+
+// Add the sign function of request, the functions are called in order they are added.
+// The signing middlewares use it to sign the request after all of other middlewares changed it.
+func AddSignFunc(ctx Context, fn SignFunc) {
+	existing := GetSignFuncs(ctx)
+	fns := make([]SignFunc, 0, len(existing)+1)
+	fns = append(fns, existing...)
+
+	ctx.Set(signFuncsKey{}, append(fns, fn))
+}
+
+// Get the sign functions of request.
+func GetSignFuncs(ctx Context) []SignFunc {
+	fns, _ := ctx.Get(signFuncsKey{}).([]SignFunc)
+
+	return fns
+}
+
 // Middleware: record the request duration
 func NewTimeMiddlewareFactory(v ...interface{}) (Middleware, error) {
 	return func(ctx Context, next Next) error {
@@ -98,7 +167,7 @@ func NewTimeMiddlewareFactory(v ...interface{}) (Middleware, error) {
 // Middleware: this middleware allow you to debug request information and response
 func NewDebugMiddlewareFactory(v ...interface{}) (Middleware, error) {
 	var cb func(ctx Context)
-	if len(v) < 0 {
+	if len(v) == 0 {
 		cb = func(ctx Context) {}
 	} else {
 		if fn, ok := v[0].(func(ctx Context)); !ok {
@@ -109,7 +178,8 @@ func NewDebugMiddlewareFactory(v ...interface{}) (Middleware, error) {
 	}
 
 	return func(ctx Context, next Next) error {
-		cb(ctx)
+		// the secrets of auth middlewares are redacted
+		cb(&redactedContext{Context: ctx})
 		return next()
 	}, nil
 }
@@ -161,92 +231,181 @@ func NewRequestExecMiddlewareFactory(v ...interface{}) (Middleware, error) {
 			return err
 		}
 
-		// create request
-		req, err := http.NewRequest(r.GetMethod(), r.GetRawUrl(), bytes.NewReader(requestBody))
+		c, err := newHttpClient(r)
 		if err != nil {
 			return err
 		}
+		signs := GetSignFuncs(ctx)
 
-		// set query string
-		req.URL.RawQuery = r.GetQueries().Encode()
-
-		// set headers
-		if r.GetHeader("Host") == "" {
-			r.SetHeader("Host", r.GetUrl().Host)
+		// Do request, retry it again if failed
+		var res Response
+		for times := 0; ; times++ {
+			res, err = doRequest(c, r, requestBody, signs)
+			if err == nil || times+1 >= r.GetRetry() {
+				ctx.Set(attemptsKey{}, times+1)
+				break
+			}
 		}
-		req.Header = r.GetHeaders()
+		if err != nil {
+			return err
+		}
+		ctx.SetRes(res)
+
+		return nil
+	}, nil
+}
 
-		// send request
-		c := http.Client{
-			Timeout: r.GetTimeout(),
+// Create the http client to send the request.
+// 1. Use the http.Client or http.RoundTripper if it is set by SetHttpClient or SetTransport.
+// 2. Use the shared transport of client if the request does not override the transport options.
+// 3. Create a dedicated transport for the request otherwise.
+func newHttpClient(r Request) (*http.Client, error) {
+	if hc := r.GetHttpClient(); hc != nil {
+		jar := r.GetCookieJar()
+		if r.GetTimeout() == 0 && (jar == nil || hc.Jar != nil) {
+			return hc, nil
 		}
 
-		// Set basic auth
-		if r.GetUsername() != "" && r.GetPassword() != "" {
-			req.SetBasicAuth(r.GetUsername(), r.GetPassword())
+		// do not change the client of user
+		c := *hc
+		if r.GetTimeout() != 0 {
+			c.Timeout = r.GetTimeout()
+		}
+		if c.Jar == nil {
+			c.Jar = jar
 		}
 
-		// set https options
-		if "https" == strings.ToLower(r.GetUrl().Scheme) {
-			tr := &http.Transport{}
-
-			// set tls options
-			if tlsConfig := r.GetTlsConfig(); tlsConfig != nil {
-				tr.TLSClientConfig = tlsConfig
-			} else {
-				tr.TLSClientConfig = &tls.Config{
-					InsecureSkipVerify: r.GetInsecureSkipVerify(),
-				}
-			}
+		return &c, nil
+	}
 
-			// Add server's root ca cert, verify the server certificate
-			if ca := r.GetCa(); ca != "" {
-				cert, err := ioutil.ReadFile(ca)
-				if err != nil {
-					return err
-				}
+	c := &http.Client{
+		Timeout: r.GetTimeout(),
+		Jar:     r.GetCookieJar(),
+	}
 
-				pool := x509.NewCertPool()
-				pool.AppendCertsFromPEM(cert)
-				tr.TLSClientConfig.RootCAs = pool
-			}
+	if tr := r.GetTransport(); tr != nil {
+		c.Transport = tr
 
-			// Set client certificate
-			if cert, key := r.GetCert(); cert != "" && key != "" {
-				clientCert, err := tls.LoadX509KeyPair(cert, key)
-				if err != nil {
-					return err
-				}
-				tr.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
-			}
+		return c, nil
+	}
 
-			c.Transport = tr
+	if ir, ok := r.(*irequest); ok && ir.Client != nil && !ir.hasTransportOptions() {
+		tr, err := ir.Client.getTransport()
+		if err != nil {
+			return nil, err
 		}
+		c.Transport = tr
 
-		// Do request, retry it again if failed
-		var resp *http.Response
-		var e error
-		if r.GetRetry() > 0 {
-			for times := 0; times < r.GetRetry(); times++ {
-				resp, e = c.Do(req)
-				if e == nil {
-					break
-				}
-			}
+		return c, nil
+	}
 
-		} else {
-			resp, e = c.Do(req)
-		}
-		if e != nil {
-			return e
+	tr, err := newTransport(r)
+	if err != nil {
+		return nil, err
+	}
+	c.Transport = &closeIdleTransport{tr}
+
+	return c, nil
+}
+
+// Send the request once, the body is reset for every attempt.
+// The sign functions of context are called right before sending, after all of middlewares changed the request.
+func doRequest(c *http.Client, r Request, body []byte, signs []SignFunc) (Response, error) {
+	tracer := &phaseTracer{}
+
+	req, err := newHttpRequest(r, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(tracer.WithContext(r.GetContext()))
+
+	for _, sign := range signs {
+		if err := sign(req, body); err != nil {
+			return nil, err
 		}
+	}
 
-		res, err := NewResponse(req, resp)
-		if err != nil {
-			return err
+	// send request over unix domain socket, the custom transport dials by itself
+	if socket := r.GetUnixSocket(); socket != "" && r.GetHttpClient() == nil && r.GetTransport() == nil {
+		if req, err = withUnixSocket(req, socket); err != nil {
+			return nil, err
 		}
-		ctx.SetRes(res)
+	}
 
-		return nil
-	}, nil
+	// the redirects are recorded for every attempt, so do not change the client shared by attempts
+	var redirects []Redirect
+	hc := *c
+	hc.CheckRedirect = newCheckRedirect(r, c.CheckRedirect, &redirects)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, tracer.wrap(err)
+	}
+
+	res, err := NewResponse(req, resp)
+	if err != nil {
+		return nil, tracer.wrap(err)
+	}
+	if ir, ok := res.(*iresponse); ok {
+		ir.Redirects = redirects
+	}
+
+	return res, nil
+}
+
+// Create the http.Request of request, include queries, headers and authorization.
+func newHttpRequest(r Request, body []byte) (*http.Request, error) {
+	// create request
+	req, err := http.NewRequest(r.GetMethod(), r.GetRawUrl(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// set query string
+	req.URL.RawQuery = r.GetQueries().Encode()
+
+	// set headers
+	if r.GetHeader("Host") == "" {
+		r.SetHeader("Host", r.GetUrl().Host)
+	}
+	// the cookies of jar are added to the headers of http.Request, do not share the headers of request
+	req.Header = cloneHeader(r.GetHeaders())
+	req.Host = r.GetHeader("Host")
+
+	// Set basic auth
+	if r.GetUsername() != "" && r.GetPassword() != "" {
+		req.SetBasicAuth(r.GetUsername(), r.GetPassword())
+	}
+
+	return req, nil
+}
+
+// The dedicated transport of a request is never reused,
+// close its idle connections once the response is read.
+type closeIdleTransport struct {
+	*http.Transport
+}
+
+func (t *closeIdleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		t.Transport.CloseIdleConnections()
+		return nil, err
+	}
+
+	resp.Body = &closeIdleBody{ReadCloser: resp.Body, transport: t.Transport}
+
+	return resp, nil
+}
+
+type closeIdleBody struct {
+	io.ReadCloser
+	transport *http.Transport
+}
+
+func (b *closeIdleBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.transport.CloseIdleConnections()
+
+	return err
 }
@@ -0,0 +1,281 @@
+package isuperagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+// The grant types of OAuth2 token endpoint
+const (
+	OAuth2GrantClientCredentials = "client_credentials"
+	OAuth2GrantPassword          = "password"
+	OAuth2GrantRefreshToken      = "refresh_token"
+)
+
+// The default time to refresh the token before it expires
+const DefaultOAuth2ExpiryDelta = 10 * time.Second
+
+type OAuth2Config struct {
+	// The token endpoint, such as https://auth.example.com/oauth2/token
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	// One of client_credentials, password and refresh_token, default is client_credentials
+	GrantType string
+	Scopes    []string
+	// The resource owner credentials of password grant
+	Username string
+	Password string
+	// The refresh token of refresh_token grant
+	RefreshToken string
+	// Extra parameters sent to the token endpoint, such as audience
+	Params map[string]string
+	// Send the client credentials in the request body instead of basic auth
+	ClientAuthInBody bool
+	// Refresh the token this long before it expires, default is DefaultOAuth2ExpiryDelta
+	ExpiryDelta time.Duration
+	// The client to call the token endpoint, the token request is sent by isuperagent as well
+	Client Client
+}
+
+// The token responded by token endpoint, see RFC 6749 section 5.1
+type OAuth2Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	// The time the token expires, zero means never
+	Expiry time.Time `json:"-"`
+}
+
+// Get the value of Authorization header, such as: Bearer xxxxx
+func (t *OAuth2Token) Authorization() string {
+	tokenType := t.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+
+	return tokenType + " " + t.AccessToken
+}
+
+// Whether the token is expired or will expire in delta
+func (t *OAuth2Token) expired(delta time.Duration) bool {
+	return !t.Expiry.IsZero() && time.Now().Add(delta).After(t.Expiry)
+}
+
+// Fetch and cache the token, the concurrent fetches are merged into one.
+type oauth2TokenSource struct {
+	config *OAuth2Config
+
+	mu    sync.Mutex
+	token *OAuth2Token
+	// the in-flight fetch, all of the callers wait for it
+	fetching chan struct{}
+	err      error
+}
+
+// Middleware: OAuth2 authorization
+//
+// Obtain the token by client_credentials, password or refresh_token grant from the token endpoint,
+// the token is cached until it is about to expire, then refreshed by the refresh token if any.
+// Concurrent requests share one fetch, and the request is retried once with a fresh token if it responds 401.
+// The middleware is created by a *OAuth2Config, such as:
+//
+//	isuperagent.NewMiddleware("oauth2", &isuperagent.OAuth2Config{TokenUrl: "https://auth.example.com/token", ClientId: "id", ClientSecret: "secret"})
+func NewOAuth2MiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.OAuth2Config")
+	}
+
+	var config OAuth2Config
+	switch c := v[0].(type) {
+	case *OAuth2Config:
+		config = *c
+	case OAuth2Config:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.OAuth2Config, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.TokenUrl == "" {
+		return nil, errors.New("oauth2 token url is required")
+	}
+	if config.GrantType == "" {
+		config.GrantType = OAuth2GrantClientCredentials
+	}
+	if config.ExpiryDelta == 0 {
+		config.ExpiryDelta = DefaultOAuth2ExpiryDelta
+	}
+
+	source := &oauth2TokenSource{config: &config}
+
+	return func(ctx Context, next Next) error {
+		r := ctx.GetReq()
+
+		token, err := source.Token(r.GetContext(), nil)
+		if err != nil {
+			return err
+		}
+		AddSecrets(ctx, token.AccessToken)
+		r.GetHeaders().Set("Authorization", token.Authorization())
+
+		if err := next(); err != nil {
+			return err
+		}
+
+		// the token may be revoked, retry once with a fresh token
+		if res := ctx.GetRes(); res == nil || res.GetStatusCode() != http.StatusUnauthorized {
+			return nil
+		}
+
+		token, err = source.Token(r.GetContext(), token)
+		if err != nil {
+			return err
+		}
+		AddSecrets(ctx, token.AccessToken)
+		r.GetHeaders().Set("Authorization", token.Authorization())
+
+		return next()
+	}, nil
+}
+
+// Get the cached token, or fetch a new one if it is about to expire.
+// The rejected token is the token rejected by server, a new token is fetched if it is still cached.
+func (s *oauth2TokenSource) Token(ctx context.Context, rejected *OAuth2Token) (*OAuth2Token, error) {
+	s.mu.Lock()
+
+	if s.token != nil && s.token != rejected && !s.token.expired(s.config.ExpiryDelta) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+
+	// start a fetch if there is no in-flight one
+	fetching := s.fetching
+	if fetching == nil {
+		fetching = make(chan struct{})
+		s.fetching = fetching
+		current := s.token
+		go s.fetch(current, fetching)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return s.token, nil
+}
+
+// Fetch the token, the refresh token of current token is used firstly.
+func (s *oauth2TokenSource) fetch(current *OAuth2Token, done chan struct{}) {
+	var token *OAuth2Token
+	var err error
+
+	if current != nil && current.RefreshToken != "" {
+		token, err = s.request(OAuth2GrantRefreshToken, current.RefreshToken)
+	}
+	// the refresh token may be expired as well, obtain a new token by the configured grant
+	if token == nil {
+		token, err = s.request(s.config.GrantType, s.config.RefreshToken)
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		// keep the refresh token if server does not return a new one
+		if token.RefreshToken == "" && current != nil {
+			token.RefreshToken = current.RefreshToken
+		}
+		s.token = token
+	}
+	s.err = err
+	s.fetching = nil
+	s.mu.Unlock()
+
+	close(done)
+}
+
+// Request the token endpoint.
+func (s *oauth2TokenSource) request(grantType, refreshToken string) (*OAuth2Token, error) {
+	c := s.config
+
+	params := url.Values{}
+	params.Set("grant_type", grantType)
+	switch grantType {
+	case OAuth2GrantPassword:
+		params.Set("username", c.Username)
+		params.Set("password", c.Password)
+	case OAuth2GrantRefreshToken:
+		params.Set("refresh_token", refreshToken)
+	}
+	if len(c.Scopes) > 0 {
+		params.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	for k, v := range c.Params {
+		params.Set(k, v)
+	}
+
+	var req Request
+	if c.Client != nil {
+		req = c.Client.NewRequest()
+	} else {
+		req = NewRequest()
+	}
+
+	if c.ClientAuthInBody {
+		params.Set("client_id", c.ClientId)
+		if c.ClientSecret != "" {
+			params.Set("client_secret", c.ClientSecret)
+		}
+	} else {
+		req.BasicAuth(url.QueryEscape(c.ClientId), url.QueryEscape(c.ClientSecret))
+	}
+
+	res, err := req.Post(c.TokenUrl, params).
+		SetContentType("application/x-www-form-urlencoded").
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		SetHeader("Accept", "application/json").
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	if res.GetStatusCode() < 200 || res.GetStatusCode() > 299 {
+		e := &ierror.OAuth2Error{StatusCode: res.GetStatusCode(), Body: string(res.GetBody().GetData())}
+		_ = res.ParseBody(e)
+
+		return nil, e
+	}
+
+	token := &OAuth2Token{}
+	if err := res.ParseBody(token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, &ierror.OAuth2Error{StatusCode: res.GetStatusCode(), Body: string(res.GetBody().GetData())}
+	}
+	if token.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
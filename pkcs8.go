@@ -0,0 +1,129 @@
+package isuperagent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The object identifiers of PKCS#5 v2.0, see RFC 8018
+var (
+	oidPBES2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSHA1  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidDesEde3Cbc    = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAes128Cbc     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAes192Cbc     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAes256Cbc     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidHmacWithSHA2s = map[string]func() hash.Hash{
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Decrypt the PKCS#8 "ENCRYPTED PRIVATE KEY", returns the DER of PKCS#8 "PRIVATE KEY".
+// Only PBES2 with PBKDF2 is supported, which is the default of OpenSSL since 1.1,
+// the cipher is one of AES-128/192/256-CBC and DES-EDE3-CBC.
+func decryptPkcs8(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse encrypted private key: %s", err))
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New(fmt.Sprintf("unsupported encryption algorithm %s of private key, only PBES2 is supported", info.Algorithm.Algorithm))
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse PBES2 parameters: %s", err))
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New(fmt.Sprintf("unsupported key derivation function %s of private key, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm))
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse PBKDF2 parameters: %s", err))
+	}
+
+	prf := sha1.New
+	if len(kdf.Prf.Algorithm) > 0 && !kdf.Prf.Algorithm.Equal(oidHmacWithSHA1) {
+		fn, ok := oidHmacWithSHA2s[kdf.Prf.Algorithm.String()]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unsupported PBKDF2 pseudorandom function %s of private key", kdf.Prf.Algorithm))
+		}
+		prf = fn
+	}
+
+	var newCipher func(key []byte) (cipher.Block, error)
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAes128Cbc):
+		newCipher, keyLen = aes.NewCipher, 16
+	case scheme.Equal(oidAes192Cbc):
+		newCipher, keyLen = aes.NewCipher, 24
+	case scheme.Equal(oidAes256Cbc):
+		newCipher, keyLen = aes.NewCipher, 32
+	case scheme.Equal(oidDesEde3Cbc):
+		newCipher, keyLen = des.NewTripleDESCipher, 24
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported cipher %s of private key", scheme))
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse the iv of cipher: %s", err))
+	}
+
+	block, err := newCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+
+	data := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.EncryptedData)
+
+	// remove the PKCS#7 padding, the wrong password results in the invalid padding mostly
+	n := int(data[len(data)-1])
+	if n == 0 || n > block.BlockSize() || n > len(data) {
+		return nil, errors.New("failed to decrypt private key: incorrect password")
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("failed to decrypt private key: incorrect password")
+		}
+	}
+
+	return data[:len(data)-n], nil
+}
@@ -0,0 +1,265 @@
+package isuperagent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+// KeyFunc returns the key to group the requests, such as the limits of rate_limit middleware.
+// The request is not grouped if the key is empty.
+type KeyFunc func(r Request) string
+
+// Group the requests by the host of url, include the port.
+func KeyByHost(r Request) string {
+	return r.GetUrl().Host
+}
+
+// Group the requests by the host and the longest matched path prefix,
+// the request matches none of the prefixes is not grouped.
+func KeyByPathPrefix(prefixes ...string) KeyFunc {
+	return func(r Request) string {
+		matched := ""
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.GetUrl().Path, prefix) && len(prefix) > len(matched) {
+				matched = prefix
+			}
+		}
+		if matched == "" {
+			return ""
+		}
+
+		return r.GetUrl().Host + matched
+	}
+}
+
+type RateLimitConfig struct {
+	// The requests per second
+	Rate float64
+	// The max requests sent at once, default is 1
+	Burst int
+	// The key of limits, default is KeyByHost, every key has its own limit
+	Key KeyFunc
+	// Return *error.RateLimitError immediately instead of waiting if the limit is exceeded
+	FailFast bool
+	// Ignore the rate limit headers and Retry-After of server
+	IgnoreServerHints bool
+}
+
+// The token bucket of key.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// No request is sent until the time, which is told by server
+	blockedUntil time.Time
+}
+
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// Middleware: client-side rate limiting
+//
+// Limit the requests by token bucket of every key, the request waits for the token until the context is done,
+// or fails with *error.RateLimitError immediately if FailFast is set.
+// The limit adapts to the server: no request is sent until the reset time if X-RateLimit-Remaining or RateLimit-Remaining is 0,
+// or until the Retry-After of 429 and 503 responses.
+// The middleware is created by a *RateLimitConfig, such as:
+//
+//	isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 10, Burst: 5})
+func NewRateLimitMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.RateLimitConfig")
+	}
+
+	var config RateLimitConfig
+	switch c := v[0].(type) {
+	case *RateLimitConfig:
+		config = *c
+	case RateLimitConfig:
+		config = c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.RateLimitConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.Rate <= 0 {
+		return nil, errors.New(fmt.Sprintf("excepted rate is greater than 0, but got %v", config.Rate))
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	if config.Key == nil {
+		config.Key = KeyByHost
+	}
+
+	l := &rateLimiter{config: config, buckets: map[string]*tokenBucket{}}
+
+	return func(ctx Context, next Next) error {
+		r := ctx.GetReq()
+
+		key := config.Key(r)
+		if key == "" {
+			return next()
+		}
+		b := l.bucket(key)
+
+		wait, ok := b.reserve(time.Now(), config.FailFast)
+		if !ok {
+			return &ierror.RateLimitError{Key: key, RetryAfter: wait}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.GetContext().Done():
+				timer.Stop()
+				b.cancel()
+				return r.GetContext().Err()
+			}
+		}
+
+		err := next()
+
+		if res := ctx.GetRes(); err == nil && res != nil && !config.IgnoreServerHints {
+			b.adapt(res, time.Now())
+		}
+
+		return err
+	}, nil
+}
+
+func (l *rateLimiter) bucket(key string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{rate: l.config.Rate, burst: float64(l.config.Burst), tokens: float64(l.config.Burst), last: time.Now()}
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// Take a token, returns the time to wait for it.
+// The token is not taken if it is not available and failFast is set.
+func (b *tokenBucket) reserve(now time.Time, failFast bool) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+
+	if wait > 0 && failFast {
+		return wait, false
+	}
+	b.tokens--
+
+	return wait, true
+}
+
+// Give back the token if the request is not sent.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// Adapt the bucket to the rate limit headers of server.
+func (b *tokenBucket) adapt(res Response, now time.Time) {
+	headers := res.GetHeaders()
+
+	var until time.Time
+	if res.GetStatusCode() == http.StatusTooManyRequests || res.GetStatusCode() == http.StatusServiceUnavailable {
+		if retryAfter, ok := parseRetryAfter(headers.Get("Retry-After"), now); ok {
+			until = now.Add(retryAfter)
+		}
+	}
+
+	remaining, reset := headers.Get("X-RateLimit-Remaining"), headers.Get("X-RateLimit-Reset")
+	if remaining == "" {
+		remaining, reset = headers.Get("RateLimit-Remaining"), headers.Get("RateLimit-Reset")
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(remaining), 64)
+	hasRemaining := err == nil && n >= 0
+
+	if hasRemaining && n < 1 {
+		if t, ok := parseRateLimitReset(reset, now); ok && t.After(until) {
+			until = t
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if hasRemaining && n < b.tokens {
+		b.tokens = n
+	}
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// Parse Retry-After in seconds or HTTP date, see RFC 7231 section 7.1.3
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// Parse the reset time of rate limit, it is the seconds to wait, or the unix time of reset such as X-RateLimit-Reset of GitHub.
+func parseRateLimitReset(v string, now time.Time) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+
+	// the seconds are too large to be a delay, it is the unix time
+	if seconds > 1e9 {
+		return time.Unix(seconds, 0), true
+	}
+
+	return now.Add(time.Duration(seconds) * time.Second), true
+}
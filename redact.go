@@ -0,0 +1,105 @@
+package isuperagent
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The placeholder of redacted secrets
+const RedactedPlaceholder = "[REDACTED]"
+
+type secretsKey struct{}
+
+// Mark the values as secrets of the request, such as tokens and api keys,
+// they are redacted in the output of debug middleware.
+func AddSecrets(ctx Context, secrets ...string) {
+	existing := GetSecrets(ctx)
+	all := make([]string, 0, len(existing)+len(secrets))
+	all = append(all, existing...)
+	for _, secret := range secrets {
+		if secret != "" {
+			all = append(all, secret)
+		}
+	}
+
+	ctx.Set(secretsKey{}, all)
+}
+
+// Get the secrets of the request.
+func GetSecrets(ctx Context) []string {
+	secrets, _ := ctx.Get(secretsKey{}).([]string)
+
+	return secrets
+}
+
+// Replace the secrets of the request in s with RedactedPlaceholder.
+func Redact(ctx Context, s string) string {
+	return redactSecrets(GetSecrets(ctx), s)
+}
+
+func redactSecrets(secrets []string, s string) string {
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, RedactedPlaceholder, -1)
+		// the secret may be escaped in url
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			s = strings.Replace(s, escaped, RedactedPlaceholder, -1)
+		}
+	}
+
+	return s
+}
+
+// The view of request which redacts the secrets in headers, queries and url.
+type redactedRequest struct {
+	Request
+	secrets []string
+}
+
+func (r *redactedRequest) GetHeader(name string) string {
+	return redactSecrets(r.secrets, r.Request.GetHeader(name))
+}
+
+func (r *redactedRequest) GetHeaders() http.Header {
+	headers := http.Header{}
+	for k, vs := range r.Request.GetHeaders() {
+		for _, v := range vs {
+			headers.Add(k, redactSecrets(r.secrets, v))
+		}
+	}
+
+	return headers
+}
+
+func (r *redactedRequest) GetQuery(name string) string {
+	return redactSecrets(r.secrets, r.Request.GetQuery(name))
+}
+
+func (r *redactedRequest) GetQueries() url.Values {
+	queries := url.Values{}
+	for k, vs := range r.Request.GetQueries() {
+		for _, v := range vs {
+			queries.Add(k, redactSecrets(r.secrets, v))
+		}
+	}
+
+	return queries
+}
+
+func (r *redactedRequest) GetRawUrl() string {
+	return redactSecrets(r.secrets, r.Request.GetRawUrl())
+}
+
+// The view of context whose request redacts the secrets.
+type redactedContext struct {
+	Context
+}
+
+func (ctx *redactedContext) GetReq() Request {
+	secrets := GetSecrets(ctx.Context)
+	if len(secrets) == 0 {
+		return ctx.Context.GetReq()
+	}
+
+	return &redactedRequest{Request: ctx.Context.GetReq(), secrets: secrets}
+}
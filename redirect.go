@@ -0,0 +1,152 @@
+package isuperagent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The default max redirects, same as http.Client
+const DefaultMaxRedirects = 10
+
+// The rules of Authorization header on redirect
+const (
+	// Keep the Authorization header on every redirect, even to other hosts
+	RedirectAuthKeep = "keep"
+	// Strip the Authorization header if the redirect goes to other host or port
+	RedirectAuthSameHost = "same_host"
+	// Strip the Authorization header on every redirect
+	RedirectAuthStrip = "strip"
+)
+
+// The redirect followed, the url is the url redirected from, the status code is the status of redirect response.
+type Redirect struct {
+	Url        string
+	StatusCode int
+}
+
+// RedirectPolicy decides whether to follow the redirect, see http.Client.CheckRedirect.
+// Return http.ErrUseLastResponse to stop following and get the redirect response, or an error to fail the request.
+type RedirectPolicy func(req *http.Request, via []*http.Request) error
+
+// RedirectMethodRule returns the method of the redirect request by the status code and method of previous request.
+// The body is sent again if the method is not changed and it is neither GET nor HEAD.
+type RedirectMethodRule func(statusCode int, method string) string
+
+// The default rule of http.Client, 301, 302 and 303 change the method to GET except HEAD, 307 and 308 keep the method.
+func RedirectMethodDefault(statusCode int, method string) string {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			return http.MethodGet
+		}
+	}
+
+	return method
+}
+
+// The strict rule of RFC 7231, only 303 changes the method to GET except HEAD, the others keep the method.
+func RedirectMethodStrict(statusCode int, method string) string {
+	if statusCode == http.StatusSeeOther && method != http.MethodHead {
+		return http.MethodGet
+	}
+
+	return method
+}
+
+// The headers of body, they are dropped if the body is not sent again
+var redirectBodyHeaders = []string{"Content-Type", "Content-Encoding", "Content-Language", "Content-Location"}
+
+// Create the http.Client.CheckRedirect of request, the followed redirects are appended to redirects.
+// The fallback is the CheckRedirect of user http.Client, it is called if the redirect policy of request is not set.
+func newCheckRedirect(r Request, fallback RedirectPolicy, redirects *[]Redirect) RedirectPolicy {
+	max := r.GetMaxRedirects()
+	auth := r.GetRedirectAuth()
+	methodRule := r.GetRedirectMethodRule()
+	policy := r.GetRedirectPolicy()
+	if policy == nil {
+		policy = fallback
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if max == 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > max {
+			return errors.New(fmt.Sprintf("stopped after %d redirects", max))
+		}
+
+		origin, prev := via[0], via[len(via)-1]
+		statusCode := 0
+		if req.Response != nil {
+			statusCode = req.Response.StatusCode
+		}
+
+		if methodRule != nil {
+			if err := rewriteRedirectMethod(req, origin, methodRule(statusCode, prev.Method)); err != nil {
+				return err
+			}
+		}
+
+		switch auth {
+		case RedirectAuthKeep:
+			if v, ok := origin.Header["Authorization"]; ok {
+				req.Header["Authorization"] = v
+			}
+		case RedirectAuthSameHost:
+			if req.URL.Host != origin.URL.Host {
+				req.Header.Del("Authorization")
+			}
+		case RedirectAuthStrip:
+			req.Header.Del("Authorization")
+		}
+
+		if policy != nil {
+			if err := policy(req, via); err != nil {
+				return err
+			}
+		}
+
+		*redirects = append(*redirects, Redirect{Url: prev.URL.String(), StatusCode: statusCode})
+
+		return nil
+	}
+}
+
+// Change the method of redirect request, the body is sent again if the method is kept.
+func rewriteRedirectMethod(req, origin *http.Request, method string) error {
+	req.Method = method
+
+	if method == origin.Method && method != http.MethodGet && method != http.MethodHead {
+		if origin.GetBody == nil {
+			return nil
+		}
+
+		body, err := origin.GetBody()
+		if err != nil {
+			return err
+		}
+		req.Body = body
+		req.GetBody = origin.GetBody
+		req.ContentLength = origin.ContentLength
+		for _, name := range redirectBodyHeaders {
+			if v, ok := origin.Header[name]; ok {
+				req.Header[name] = v
+			}
+		}
+
+		return nil
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	req.Body = nil
+	req.GetBody = nil
+	req.ContentLength = 0
+	for _, name := range redirectBodyHeaders {
+		req.Header.Del(name)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package isuperagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader reloads the certificate files of client when they are changed,
+// such as the certificates rotated by a sidecar.
+//
+// The files are polled at most once per interval when the client sends requests.
+// The new client certificate is used by the new TLS handshakes of the shared transport by GetClientCertificate,
+// the shared transport is replaced if the CA certificates changed.
+// Both of them do not affect the in-flight requests.
+type certReloader struct {
+	certs    *certificates
+	interval time.Duration
+	onError  func(err error)
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	modTimes  map[string]time.Time
+	loaded    bool
+
+	rootCAs     *x509.CertPool
+	clientCerts []tls.Certificate
+}
+
+func newCertReloader(certs *certificates, interval time.Duration, onError func(err error)) *certReloader {
+	return &certReloader{certs: certs, interval: interval, onError: onError}
+}
+
+// Reload the certificates at next check.
+func (rl *certReloader) forget() {
+	rl.mu.Lock()
+	rl.modTimes = nil
+	rl.checkedAt = time.Time{}
+	rl.mu.Unlock()
+}
+
+// Check the files and reload them if changed, returns whether the CA certificates changed.
+// The previous certificates are kept if reload failed, the error is returned only if no certificate is loaded yet.
+func (rl *certReloader) check() (bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if rl.loaded && now.Sub(rl.checkedAt) < rl.interval {
+		return false, nil
+	}
+	rl.checkedAt = now
+
+	modTimes := map[string]time.Time{}
+	for _, file := range []string{rl.certs.Ca, rl.certs.Cert, rl.certs.Key} {
+		if file == "" {
+			continue
+		}
+
+		// the error is reported when reading the file
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+
+	if rl.loaded && sameModTimes(rl.modTimes, modTimes) {
+		return false, nil
+	}
+
+	// parse the files by a copy, so the previous certificates are kept if failed
+	certs := &certificates{
+		Ca:             rl.certs.Ca,
+		CaPem:          rl.certs.CaPem,
+		Cert:           rl.certs.Cert,
+		Key:            rl.certs.Key,
+		CertPem:        rl.certs.CertPem,
+		KeyPem:         rl.certs.KeyPem,
+		KeyPassword:    rl.certs.KeyPassword,
+		Pkcs12:         rl.certs.Pkcs12,
+		Pkcs12Password: rl.certs.Pkcs12Password,
+		Certificates:   rl.certs.Certificates,
+	}
+
+	rootCAs, err := certs.getRootCAs()
+	if err == nil {
+		rl.clientCerts, err = certs.getClientCertificates()
+	}
+	if err != nil {
+		if !rl.loaded {
+			return false, err
+		}
+
+		if rl.onError != nil {
+			rl.onError(err)
+		}
+
+		return false, nil
+	}
+
+	caChanged := rl.loaded && (rl.certs.Ca != "" && !rl.modTimes[rl.certs.Ca].Equal(modTimes[rl.certs.Ca]))
+	rl.rootCAs = rootCAs
+	rl.modTimes = modTimes
+	rl.loaded = true
+
+	return caChanged, nil
+}
+
+func (rl *certReloader) getRootCAs() *x509.CertPool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.rootCAs
+}
+
+func (rl *certReloader) getClientCertificates() []tls.Certificate {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.clientCerts
+}
+
+// Used as tls.Config.GetClientCertificate, returns the current client certificate.
+func (rl *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certs := rl.getClientCertificates()
+	if len(certs) == 0 {
+		// no certificate is sent
+		return &tls.Certificate{}, nil
+	}
+
+	return &certs[0], nil
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if !v.Equal(b[k]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,65 @@
+package isuperagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Resolver looks up the IP addresses of host, *net.Resolver implements this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Resolve the address by the overrides and resolver before dialing.
+// Only the dialed address is changed, the url, Host header and TLS server name still use the original hostname.
+func resolveDial(dial DialContextFunc, overrides map[string]string, resolver Resolver) DialContextFunc {
+	if len(overrides) == 0 && resolver == nil {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+
+		// the override of "host:port" takes precedence over "host"
+		if ip, ok := overrides[net.JoinHostPort(host, port)]; ok {
+			return dial(ctx, network, net.JoinHostPort(ip, port))
+		}
+		if ip, ok := overrides[host]; ok {
+			return dial(ctx, network, net.JoinHostPort(ip, port))
+		}
+
+		if resolver == nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, errors.New(fmt.Sprintf("no such host %s", host))
+		}
+
+		// try the addresses one by one, return the first error if all of them failed
+		var firstErr error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, firstErr
+	}
+}
@@ -1,6 +1,7 @@
 package isuperagent
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net/http"
 
@@ -14,6 +15,12 @@ type Response interface {
 	ParseBody(v interface{}) error
 	GetStatusCode() int
 	GetStatusText() string
+	GetProto() string
+	GetTlsVersion() uint16
+	GetNegotiatedProtocol() string
+	GetCookies() []*http.Cookie
+	GetRedirects() []Redirect
+	IsFromCache() bool
 
 	GetHttpRequest() *http.Request
 	GetHttpResponse() *http.Response
@@ -30,6 +37,16 @@ type iresponse struct {
 	Body       *Body
 	Headers    http.Header
 
+	// The protocol of response, such as HTTP/1.1 or HTTP/2.0
+	Proto string
+	// The TLS version and ALPN protocol negotiated with server, empty for http
+	TlsVersion         uint16
+	NegotiatedProtocol string
+	// The redirects followed before the response
+	Redirects []Redirect
+	// The response is served from the cache middleware
+	FromCache bool
+
 	HttpReq  *http.Request
 	HttpResp *http.Response
 }
@@ -44,7 +61,9 @@ func (b *Body) GetData() []byte {
 }
 
 func (b *Body) Unmarshal(v interface{}) error {
-	err := bodyParser.Unmarshal(b.contentType, b.data, v)
+	// the parser is selected by media type, the parameters such as charset are ignored
+	contentType := ParseContentType(b.contentType)
+	err := bodyParser.Unmarshal(contentType.MediaType, b.data, v)
 	if err != nil {
 		return err
 	}
@@ -58,6 +77,11 @@ func NewResponse(req *http.Request, resp *http.Response) (Response, error) {
 	res.StatusCode = resp.StatusCode
 	res.StatusText = resp.Status
 	res.Headers = resp.Header
+	res.Proto = resp.Proto
+	if resp.TLS != nil {
+		res.TlsVersion = resp.TLS.Version
+		res.NegotiatedProtocol = resp.TLS.NegotiatedProtocol
+	}
 
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -96,6 +120,35 @@ func (r *iresponse) GetStatusText() string {
 	return r.StatusText
 }
 
+func (r *iresponse) GetProto() string {
+	return r.Proto
+}
+
+// Get the negotiated TLS version, such as tls.VersionTLS13, 0 if the request is not https.
+func (r *iresponse) GetTlsVersion() uint16 {
+	return r.TlsVersion
+}
+
+// Get the protocol negotiated by ALPN, such as h2 or http/1.1, empty if not negotiated.
+func (r *iresponse) GetNegotiatedProtocol() string {
+	return r.NegotiatedProtocol
+}
+
+// Get the cookies of the Set-Cookie headers.
+func (r *iresponse) GetCookies() []*http.Cookie {
+	return (&http.Response{Header: r.Headers}).Cookies()
+}
+
+// Get the redirects followed before the response, in the order they are followed.
+func (r *iresponse) GetRedirects() []Redirect {
+	return r.Redirects
+}
+
+// Whether the response is served from cache, see the cache middleware.
+func (r *iresponse) IsFromCache() bool {
+	return r.FromCache
+}
+
 func (r *iresponse) GetHttpRequest() *http.Request {
 	return r.HttpReq
 }
@@ -103,3 +156,25 @@ func (r *iresponse) GetHttpRequest() *http.Request {
 func (r *iresponse) GetHttpResponse() *http.Response {
 	return r.HttpResp
 }
+
+// Copy the response, so the copy can be changed and read independently.
+// The body and headers are copied, the http.Request is shared.
+func (r *iresponse) clone() *iresponse {
+	n := *r
+	n.Headers = cloneHeader(r.Headers)
+	n.Redirects = append([]Redirect(nil), r.Redirects...)
+	if r.Body != nil {
+		n.Body = &Body{data: append([]byte(nil), r.Body.data...), contentType: r.Body.contentType}
+	}
+
+	if r.HttpResp != nil {
+		resp := *r.HttpResp
+		resp.Header = n.Headers
+		if n.Body != nil {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(n.Body.data))
+		}
+		n.HttpResp = &resp
+	}
+
+	return &n
+}
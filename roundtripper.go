@@ -0,0 +1,97 @@
+package isuperagent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// RoundTripper exposes the middleware chain of isuperagent as an http.RoundTripper,
+// so other libraries which accept an http.Client can reuse the middlewares.
+//
+// Every request is converted to an isuperagent request, passes all of the middlewares,
+// then is sent by the underlying transport.
+type RoundTripper struct {
+	// The underlying transport, http.DefaultTransport is used if nil
+	Transport   http.RoundTripper
+	Middlewares []Middleware
+}
+
+func NewRoundTripper(transport http.RoundTripper, middlewares ...Middleware) *RoundTripper {
+	return &RoundTripper{Transport: transport, Middlewares: middlewares}
+}
+
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := NewRequestFromHttp(req)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	res, err := r.SetTransport(transport).Middleware(t.Middlewares...).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewHttpResponse(req, res), nil
+}
+
+// Convert the http.Request to isuperagent request, the body of http.Request is read and closed.
+func NewRequestFromHttp(req *http.Request) (Request, error) {
+	r := NewRequestWithContext(req.Context()).SetMethod(req.Method, req.URL.String())
+
+	for name, values := range req.Header {
+		for _, value := range values {
+			r.SetHeader(name, value)
+		}
+	}
+	if req.Host != "" && r.GetHeader("Host") == "" {
+		r.SetHeader("Host", req.Host)
+	}
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.SetBody(body)
+	}
+
+	return r, nil
+}
+
+// Convert the isuperagent response to http.Response, the body can be read again.
+func NewHttpResponse(req *http.Request, res Response) *http.Response {
+	var data []byte
+	if body := res.GetBody(); body != nil {
+		data = body.GetData()
+	}
+
+	resp := &http.Response{}
+	if hr := res.GetHttpResponse(); hr != nil {
+		*resp = *hr
+	} else {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		resp.Status = res.GetStatusText()
+		if resp.Status == "" {
+			resp.Status = strconv.Itoa(res.GetStatusCode()) + " " + http.StatusText(res.GetStatusCode())
+		}
+	}
+
+	resp.StatusCode = res.GetStatusCode()
+	resp.Header = res.GetHeaders()
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Request = req
+
+	return resp
+}
@@ -0,0 +1,469 @@
+package isuperagent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The payload hashes of AWS Signature Version 4
+const (
+	SigV4UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	SigV4StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm   = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4TimeFormat       = "20060102T150405Z"
+	sigV4DateFormat       = "20060102"
+	sigV4EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// The max expiration of presigned url, 7 days
+	sigV4MaxExpires = 7 * 24 * time.Hour
+)
+
+// The default chunk size of streaming signature, 64KB
+const DefaultSigV4ChunkSize = 64 * 1024
+
+// The headers never signed, they may be changed by proxies or the http client.
+var sigV4IgnoredHeaders = map[string]bool{
+	"Authorization":   true,
+	"User-Agent":      true,
+	"X-Amzn-Trace-Id": true,
+	"Expect":          true,
+	"Connection":      true,
+	"Content-Length":  true,
+	"Host":            true,
+}
+
+// The AWS credentials
+type SigV4Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	// The session token of temporary credentials
+	SessionToken string
+}
+
+// Static credentials are the provider of themselves.
+func (c SigV4Credentials) Retrieve() (SigV4Credentials, error) {
+	return c, nil
+}
+
+// The provider of AWS credentials, it is called for every request.
+type SigV4CredentialsProvider interface {
+	Retrieve() (SigV4Credentials, error)
+}
+
+// Read the credentials from the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type EnvSigV4Credentials struct{}
+
+func (EnvSigV4Credentials) Retrieve() (SigV4Credentials, error) {
+	c := SigV4Credentials{
+		AccessKeyId:     getEnvAny("AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"),
+		SecretAccessKey: getEnvAny("AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyId == "" || c.SecretAccessKey == "" {
+		return c, errors.New("environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	return c, nil
+}
+
+type SigV4Config struct {
+	// The region, default is the environment variable AWS_REGION, AWS_DEFAULT_REGION, then us-east-1
+	Region string
+	// The service name, such as s3
+	Service string
+	// The credentials, default is read from the environment variables
+	Credentials SigV4CredentialsProvider
+	// Do not sign the payload, the payload hash is UNSIGNED-PAYLOAD
+	UnsignedPayload bool
+	// Sign the payload in chunks (aws-chunked), every chunk is signed by the signature of previous one
+	Streaming bool
+	// The chunk size of streaming signature, default is DefaultSigV4ChunkSize
+	ChunkSize int
+}
+
+// Sign the http.Request by AWS Signature Version 4.
+type SigV4Signer struct {
+	config SigV4Config
+}
+
+func NewSigV4Signer(config *SigV4Config) *SigV4Signer {
+	c := *config
+	if c.Region == "" {
+		c.Region = getEnvAny("AWS_REGION", "AWS_DEFAULT_REGION")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Credentials == nil {
+		c.Credentials = EnvSigV4Credentials{}
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultSigV4ChunkSize
+	}
+
+	return &SigV4Signer{config: c}
+}
+
+// Middleware: AWS Signature Version 4
+//
+// The request is signed right before it is sent, after all of other middlewares changed the headers, queries and body,
+// and it is signed again for every attempt of retry.
+// The middleware is created by a *SigV4Config, such as:
+//
+//	isuperagent.NewMiddleware("sigv4", &isuperagent.SigV4Config{Region: "us-east-1", Service: "s3"})
+func NewSigV4MiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is *isuperagent.SigV4Config")
+	}
+
+	var config *SigV4Config
+	switch c := v[0].(type) {
+	case *SigV4Config:
+		config = c
+	case SigV4Config:
+		config = &c
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.SigV4Config, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	if config.Service == "" {
+		return nil, errors.New("sigv4 service is required")
+	}
+
+	signer := NewSigV4Signer(config)
+
+	return func(ctx Context, next Next) error {
+		AddSignFunc(ctx, func(req *http.Request, body []byte) error {
+			return signer.Sign(req, body, time.Now())
+		})
+
+		return next()
+	}, nil
+}
+
+// Create the presigned url of request, it is valid for the duration of expires, 7 days at most.
+func PresignSigV4(r Request, config *SigV4Config, expires time.Duration) (string, error) {
+	req, err := newHttpRequest(r, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return NewSigV4Signer(config).Presign(req, expires, time.Now())
+}
+
+// Sign the request by the Authorization header, the body is the raw request body.
+// The body of request is replaced by the aws-chunked encoded body if streaming signature is enabled.
+func (s *SigV4Signer) Sign(req *http.Request, body []byte, signTime time.Time) error {
+	creds, err := s.config.Credentials.Retrieve()
+	if err != nil {
+		return err
+	}
+
+	signTime = signTime.UTC()
+	amzDate := signTime.Format(sigV4TimeFormat)
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	var payloadHash string
+	var contentLength int64 = -1
+	switch {
+	case s.config.Streaming:
+		payloadHash = SigV4StreamingPayload
+		contentLength = s.chunkedLength(int64(len(body)))
+		req.Header.Set("Content-Encoding", "aws-chunked")
+		req.Header.Set("X-Amz-Decoded-Content-Length", strconv.Itoa(len(body)))
+	case s.config.UnsignedPayload:
+		payloadHash = SigV4UnsignedPayload
+	default:
+		payloadHash = sha256Hex(body)
+	}
+
+	// S3 requires the payload hash header, the other services only need it if the payload is not signed
+	if s.config.Service == "s3" || s.config.UnsignedPayload || s.config.Streaming {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signedHeaders, canonicalHeaders := s.canonicalHeaders(req, contentLength)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalUri(req.URL),
+		canonicalQuery(req.URL.RawQuery),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(signTime)
+	key := s.signingKey(creds.SecretAccessKey, signTime)
+	signature := hmacHex(key, sigV4Algorithm+"\n"+amzDate+"\n"+scope+"\n"+sha256Hex([]byte(canonicalRequest)))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyId, scope, signedHeaders, signature))
+
+	if s.config.Streaming {
+		chunked := s.encodeChunks(body, key, amzDate, scope, signature)
+		req.ContentLength = int64(len(chunked))
+		req.Body = ioutil.NopCloser(bytes.NewReader(chunked))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(chunked)), nil
+		}
+	}
+
+	return nil
+}
+
+// Create the presigned url of request, the signature is in the query string.
+func (s *SigV4Signer) Presign(req *http.Request, expires time.Duration, signTime time.Time) (string, error) {
+	if expires <= 0 || expires > sigV4MaxExpires {
+		return "", errors.New(fmt.Sprintf("excepted expires is between 1s and 7 days, but got %s", expires))
+	}
+
+	creds, err := s.config.Credentials.Retrieve()
+	if err != nil {
+		return "", err
+	}
+
+	signTime = signTime.UTC()
+	amzDate := signTime.Format(sigV4TimeFormat)
+	scope := s.scope(signTime)
+
+	u := *req.URL
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", creds.AccessKeyId+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	query.Del("X-Amz-Signature")
+	u.RawQuery = encodeSigV4Query(query)
+
+	payloadHash := sigV4EmptyPayloadHash
+	if s.config.Service == "s3" {
+		payloadHash = SigV4UnsignedPayload
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalUri(&u),
+		u.RawQuery,
+		"host:" + requestHost(req) + "\n",
+		"host",
+		payloadHash,
+	}, "\n")
+
+	key := s.signingKey(creds.SecretAccessKey, signTime)
+	signature := hmacHex(key, sigV4Algorithm+"\n"+amzDate+"\n"+scope+"\n"+sha256Hex([]byte(canonicalRequest)))
+	u.RawQuery += "&X-Amz-Signature=" + signature
+
+	return u.String(), nil
+}
+
+func (s *SigV4Signer) scope(signTime time.Time) string {
+	return strings.Join([]string{signTime.Format(sigV4DateFormat), s.config.Region, s.config.Service, "aws4_request"}, "/")
+}
+
+func (s *SigV4Signer) signingKey(secret string, signTime time.Time) []byte {
+	key := hmacSha256([]byte("AWS4"+secret), signTime.Format(sigV4DateFormat))
+	key = hmacSha256(key, s.config.Region)
+	key = hmacSha256(key, s.config.Service)
+
+	return hmacSha256(key, "aws4_request")
+}
+
+// The path is URI-encoded twice except S3.
+func (s *SigV4Signer) canonicalUri(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segment = sigV4Escape(segment)
+		if s.config.Service != "s3" {
+			segment = sigV4Escape(segment)
+		}
+		segments[i] = segment
+	}
+
+	uri := strings.Join(segments, "/")
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+
+	return uri
+}
+
+// The content length is signed for streaming signature, it is -1 otherwise.
+func (s *SigV4Signer) canonicalHeaders(req *http.Request, contentLength int64) (string, string) {
+	headers := map[string]string{"host": requestHost(req)}
+	if contentLength >= 0 {
+		headers["content-length"] = strconv.FormatInt(contentLength, 10)
+	}
+
+	for name, values := range req.Header {
+		if sigV4IgnoredHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		buf.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	return strings.Join(names, ";"), buf.String()
+}
+
+// The length of aws-chunked encoded body.
+func (s *SigV4Signer) chunkedLength(size int64) int64 {
+	chunkSize := int64(s.config.ChunkSize)
+	chunkLength := func(n int64) int64 {
+		// hex(n);chunk-signature=<64>\r\n<data>\r\n
+		return int64(len(strconv.FormatInt(n, 16))) + int64(len(";chunk-signature=")) + 64 + 2 + n + 2
+	}
+
+	length := (size / chunkSize) * chunkLength(chunkSize)
+	if rest := size % chunkSize; rest > 0 {
+		length += chunkLength(rest)
+	}
+
+	return length + chunkLength(0)
+}
+
+// Encode the body in chunks, every chunk is signed by the signature of previous one, ends with an empty chunk.
+func (s *SigV4Signer) encodeChunks(body, key []byte, amzDate, scope, signature string) []byte {
+	var buf bytes.Buffer
+
+	for {
+		n := len(body)
+		if n > s.config.ChunkSize {
+			n = s.config.ChunkSize
+		}
+		chunk := body[:n]
+		body = body[n:]
+
+		signature = hmacHex(key, strings.Join([]string{
+			sigV4ChunkAlgorithm, amzDate, scope, signature, sigV4EmptyPayloadHash, sha256Hex(chunk),
+		}, "\n"))
+
+		buf.WriteString(fmt.Sprintf("%x;chunk-signature=%s\r\n", n, signature))
+		buf.Write(chunk)
+		buf.WriteString("\r\n")
+
+		if n == 0 {
+			break
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+
+	return req.URL.Host
+}
+
+// Sort the query by name then value, both are URI-encoded.
+func canonicalQuery(rawQuery string) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+
+	return encodeSigV4Query(query)
+}
+
+func encodeSigV4Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return sigV4Escape(names[i]) < sigV4Escape(names[j])
+	})
+
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := make([]string, len(query[name]))
+		for i, v := range query[name] {
+			values[i] = sigV4Escape(v)
+		}
+		sort.Strings(values)
+
+		for _, v := range values {
+			pairs = append(pairs, sigV4Escape(name)+"="+v)
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// URI-encode every byte except the unreserved characters, see RFC 3986 section 2.3
+func sigV4Escape(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func hmacHex(key []byte, data string) string {
+	return hex.EncodeToString(hmacSha256(key, data))
+}
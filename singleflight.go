@@ -0,0 +1,161 @@
+package isuperagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The credential headers always in the default key of singleflight middleware
+var DefaultSingleFlightHeaders = []string{"Authorization", "Cookie"}
+
+type SingleFlightConfig struct {
+	// The request headers in the key besides DefaultSingleFlightHeaders, such as X-Api-Key,
+	// the requests of different headers are not shared
+	Headers []string
+	// The methods to share, default is GET and HEAD
+	Methods []string
+	// The key of requests, the request is not shared if the key is empty.
+	// Default is the method, url, basic auth, cookie jar, DefaultSingleFlightHeaders and the Headers,
+	// so the requests of different credentials are never shared.
+	Key KeyFunc
+}
+
+type flightCall struct {
+	done chan struct{}
+	// The context of the request sent, the others send the request by themselves if it is canceled
+	leaderCtx context.Context
+	// The snapshot of response, it is never changed, the others get a copy of it
+	res Response
+	err error
+}
+
+type singleFlight struct {
+	config  SingleFlightConfig
+	methods map[string]bool
+
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type singleFlightSharedKey struct{}
+
+// Middleware: single-flight deduplication
+//
+// The identical requests in flight share one request, the first one is sent and the others wait for it,
+// then they get a copy of the response, or the same error.
+// The middleware is created by an optional *SingleFlightConfig, such as:
+//
+//	isuperagent.NewMiddleware("singleflight", &isuperagent.SingleFlightConfig{Headers: []string{"X-Api-Key"}})
+func NewSingleFlightMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	var config SingleFlightConfig
+	if len(v) > 0 {
+		switch c := v[0].(type) {
+		case *SingleFlightConfig:
+			config = *c
+		case SingleFlightConfig:
+			config = c
+		default:
+			return nil, errors.New(fmt.Sprintf("excepted first argument is *isuperagent.SingleFlightConfig, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+		}
+	}
+
+	if len(config.Methods) == 0 {
+		config.Methods = []string{http.MethodGet, http.MethodHead}
+	}
+	if config.Key == nil {
+		headers := append(append([]string{}, DefaultSingleFlightHeaders...), config.Headers...)
+		config.Key = func(r Request) string {
+			key := r.GetMethod() + " " + r.GetRawUrl()
+			key += "\nBasic: " + r.GetUsername() + ":" + r.GetPassword()
+			key += fmt.Sprintf("\nJar: %p", r.GetCookieJar())
+			for _, name := range headers {
+				key += "\n" + http.CanonicalHeaderKey(name) + ": " + strings.Join(r.GetHeaders()[http.CanonicalHeaderKey(name)], ", ")
+			}
+			return key
+		}
+	}
+
+	s := &singleFlight{config: config, methods: map[string]bool{}, calls: map[string]*flightCall{}}
+	for _, method := range config.Methods {
+		s.methods[method] = true
+	}
+
+	return s.middleware, nil
+}
+
+func (s *singleFlight) middleware(ctx Context, next Next) error {
+	r := ctx.GetReq()
+	if !s.methods[r.GetMethod()] {
+		return next()
+	}
+
+	key := s.config.Key(r)
+	if key == "" {
+		return next()
+	}
+
+	s.mu.Lock()
+	if c, ok := s.calls[key]; ok {
+		s.mu.Unlock()
+
+		// wait for the request in flight
+		select {
+		case <-c.done:
+		case <-r.GetContext().Done():
+			return r.GetContext().Err()
+		}
+		// send the request itself if the shared request is canceled by its own context,
+		// the error of http.Client is wrapped, so check the context instead of the error
+		if c.res == nil && (c.err == nil || c.leaderCtx.Err() != nil) {
+			return next()
+		}
+		if c.err != nil {
+			return c.err
+		}
+
+		res := c.res
+		if ir, ok := res.(*iresponse); ok {
+			res = ir.clone()
+		}
+		ctx.SetRes(res)
+		ctx.Set(singleFlightSharedKey{}, true)
+
+		return nil
+	}
+
+	c := &flightCall{done: make(chan struct{}), leaderCtx: r.GetContext()}
+	s.calls[key] = c
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.calls, key)
+		s.mu.Unlock()
+		close(c.done)
+	}()
+
+	// the response is copied before the others are woken up,
+	// the upstream middlewares may change the response of ctx after it returns
+	err := next()
+	c.err = err
+	if err == nil {
+		c.res = ctx.GetRes()
+		if ir, ok := c.res.(*iresponse); ok {
+			c.res = ir.clone()
+		}
+	}
+
+	return err
+}
+
+// Whether the response is shared from the identical request in flight, see the singleflight middleware.
+func IsSharedResponse(ctx Context) bool {
+	shared, _ := ctx.Get(singleFlightSharedKey{}).(bool)
+
+	return shared
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+func TestSuperAgent_Bulkhead(t *testing.T) {
+	ast := assert.New(t)
+
+	// 服务端阻塞直到 release 关闭，记录最大并发数
+	release := make(chan struct{})
+	var concurrent, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&concurrent, 1)
+		defer atomic.AddInt32(&concurrent, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var last isuperagent.BulkheadMetrics
+	bulkhead, err := isuperagent.NewMiddleware("bulkhead", &isuperagent.BulkheadConfig{
+		MaxConcurrent: 2,
+		MaxQueue:      1,
+		QueueTimeout:  100 * time.Millisecond,
+		OnMetrics: func(metrics isuperagent.BulkheadMetrics) {
+			mu.Lock()
+			defer mu.Unlock()
+			last = metrics
+		},
+	})
+	ast.Nil(err)
+	metrics := func() isuperagent.BulkheadMetrics {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+	get := func() error {
+		_, err := isuperagent.NewRequest().Get(srv.URL).Middleware(bulkhead).Do()
+		return err
+	}
+
+	// 占满并发
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ast.Nil(get())
+		}()
+	}
+	ast.Eventually(func() bool { return metrics().InFlight == 2 }, time.Second, 5*time.Millisecond)
+
+	// 排队等待超时
+	queued := make(chan error, 1)
+	go func() { queued <- get() }()
+	ast.Eventually(func() bool { return metrics().Queued == 1 }, time.Second, 5*time.Millisecond)
+
+	// 队列已满，立即拒绝
+	err = get()
+	if ast.IsType(&ierror.BulkheadError{}, err) {
+		ast.Equal(ierror.BulkheadQueueFull, err.(*ierror.BulkheadError).Reason)
+	}
+
+	err = <-queued
+	if ast.IsType(&ierror.BulkheadError{}, err) {
+		ast.Equal(ierror.BulkheadQueueTimeout, err.(*ierror.BulkheadError).Reason)
+	}
+
+	// 排队中的请求在有空位后发送
+	go func() { queued <- get() }()
+	ast.Eventually(func() bool { return metrics().Queued == 1 }, time.Second, 5*time.Millisecond)
+	close(release)
+	ast.Nil(<-queued)
+	wg.Wait()
+
+	m := metrics()
+	ast.Equal(0, m.InFlight)
+	ast.Equal(0, m.Queued)
+	ast.Equal(1, m.MaxQueued)
+	ast.Equal(int64(1), m.Rejected)
+	ast.Equal(int64(1), m.TimedOut)
+	ast.Equal(int32(2), atomic.LoadInt32(&peak))
+
+	_, err = isuperagent.NewMiddleware("bulkhead", &isuperagent.BulkheadConfig{})
+	ast.NotNil(err)
+}
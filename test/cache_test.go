@@ -0,0 +1,160 @@
+package test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_Cache(t *testing.T) {
+	ast := assert.New(t)
+
+	var hits, failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			// 每次都需要重新验证
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		case "/swr":
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		case "/sie":
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		_, _ = w.Write([]byte(strconv.Itoa(int(n))))
+	}))
+	defer srv.Close()
+
+	store := isuperagent.NewLruCacheStore(100)
+	cache, err := isuperagent.NewMiddleware("cache", store)
+	ast.Nil(err)
+	get := func(path string) isuperagent.Response {
+		res, err := isuperagent.NewRequest().Get(srv.URL + path).Middleware(cache).Do()
+		ast.Nil(err)
+		return res
+	}
+
+	// 新鲜的响应直接从缓存返回
+	res := get("/fresh")
+	ast.False(res.IsFromCache())
+	body := string(res.GetBody().GetData())
+	res = get("/fresh")
+	ast.True(res.IsFromCache())
+	ast.Equal(body, string(res.GetBody().GetData()))
+	ast.NotEmpty(res.GetHeaders().Get("Age"))
+
+	// 请求 no-cache 时重新请求
+	res, err = isuperagent.NewRequest().Get(srv.URL+"/fresh").SetHeader("Cache-Control", "no-cache").Middleware(cache).Do()
+	ast.Nil(err)
+	ast.False(res.IsFromCache())
+
+	// ETag 重新验证，304 时返回缓存的内容
+	body = string(get("/etag").GetBody().GetData())
+	before := atomic.LoadInt32(&hits)
+	res = get("/etag")
+	ast.True(res.IsFromCache())
+	ast.Equal(200, res.GetStatusCode())
+	ast.Equal(body, string(res.GetBody().GetData()))
+	ast.Equal(before+1, atomic.LoadInt32(&hits))
+
+	// Vary 的不同取值分别缓存
+	for _, lang := range []string{"en", "zh", "en", "zh"} {
+		res, err = isuperagent.NewRequest().Get(srv.URL+"/vary").SetHeader("Accept-Language", lang).Middleware(cache).Do()
+		ast.Nil(err)
+		ast.Equal(lang, string(res.GetBody().GetData()))
+	}
+	ast.True(res.IsFromCache())
+
+	// stale-while-revalidate 先返回过期的响应，后台更新缓存
+	body = string(get("/swr").GetBody().GetData())
+	res = get("/swr")
+	ast.True(res.IsFromCache())
+	ast.Equal(body, string(res.GetBody().GetData()))
+	ast.Eventually(func() bool {
+		return string(get("/swr").GetBody().GetData()) != body
+	}, time.Second, 10*time.Millisecond)
+
+	// stale-if-error 在服务端出错时返回过期的响应
+	body = string(get("/sie").GetBody().GetData())
+	atomic.StoreInt32(&failing, 1)
+	res = get("/sie")
+	ast.True(res.IsFromCache())
+	ast.Equal(body, string(res.GetBody().GetData()))
+
+	// no-store 不缓存，only-if-cached 未命中时返回 504
+	get("/no-store")
+	res, err = isuperagent.NewRequest().Get(srv.URL+"/no-store").SetHeader("Cache-Control", "only-if-cached").Middleware(cache).Do()
+	ast.Nil(err)
+	ast.Equal(http.StatusGatewayTimeout, res.GetStatusCode())
+
+	// 修改资源后缓存失效
+	ast.True(get("/fresh").IsFromCache())
+	_, err = isuperagent.NewRequest().Post(srv.URL + "/fresh").Middleware(cache).Do()
+	ast.Nil(err)
+	ast.False(get("/fresh").IsFromCache())
+}
+
+func TestSuperAgent_CacheStores(t *testing.T) {
+	ast := assert.New(t)
+
+	// LRU 超出容量时淘汰最久未使用的
+	lru := isuperagent.NewLruCacheStore(2)
+	ast.Nil(lru.Set("a", []byte("1")))
+	ast.Nil(lru.Set("b", []byte("2")))
+	_, ok, _ := lru.Get("a")
+	ast.True(ok)
+	ast.Nil(lru.Set("c", []byte("3")))
+	_, ok, _ = lru.Get("b")
+	ast.False(ok)
+	ast.Equal(2, lru.Len())
+
+	// 磁盘存储
+	dir, err := ioutil.TempDir("", "isuperagent-cache")
+	ast.Nil(err)
+	defer os.RemoveAll(dir)
+
+	disk, err := isuperagent.NewDiskCacheStore(dir)
+	ast.Nil(err)
+	ast.Nil(disk.Set("GET http://example.com/", []byte("data")))
+	data, ok, err := disk.Get("GET http://example.com/")
+	ast.Nil(err)
+	ast.True(ok)
+	ast.Equal("data", string(data))
+	ast.Nil(disk.Delete("GET http://example.com/"))
+	_, ok, err = disk.Get("GET http://example.com/")
+	ast.Nil(err)
+	ast.False(ok)
+
+	_, err = isuperagent.NewMiddleware("cache", "store")
+	ast.NotNil(err)
+}
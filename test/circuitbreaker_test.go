@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+func TestSuperAgent_CircuitBreaker(t *testing.T) {
+	ast := assert.New(t)
+
+	var failing, hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+			return
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var changes []string
+	breaker, err := isuperagent.NewMiddleware("circuit_breaker", &isuperagent.CircuitBreakerConfig{
+		MinRequests:   4,
+		FailureRatio:  0.5,
+		OpenTimeout:   100 * time.Millisecond,
+		SlowThreshold: 20 * time.Millisecond,
+		OnStateChange: func(key, from, to string) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, from+"->"+to)
+		},
+	})
+	ast.Nil(err)
+	get := func(path string) (isuperagent.Response, error) {
+		return isuperagent.NewRequest().Get(srv.URL + path).Middleware(breaker).Do()
+	}
+
+	// 失败率未达到阈值时保持关闭
+	for i := 0; i < 3; i++ {
+		_, err = get("/")
+		ast.Nil(err)
+	}
+
+	// 5xx 达到失败率后打开
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 3; i++ {
+		res, err := get("/")
+		ast.Nil(err)
+		ast.Equal(http.StatusBadGateway, res.GetStatusCode())
+	}
+	before := atomic.LoadInt32(&hits)
+	_, err = get("/")
+	if ast.IsType(&ierror.CircuitOpenError{}, err) {
+		ast.Equal(isuperagent.CircuitOpen, err.(*ierror.CircuitOpenError).State)
+		ast.True(err.(*ierror.CircuitOpenError).RetryAfter > 0)
+		ast.Equal(ierror.ErrCircuitOpen, err.(*ierror.CircuitOpenError).Unwrap())
+	}
+	ast.Equal(before, atomic.LoadInt32(&hits))
+
+	// 半开状态探测失败，重新打开
+	time.Sleep(120 * time.Millisecond)
+	_, err = get("/")
+	ast.Nil(err)
+	_, err = get("/")
+	ast.IsType(&ierror.CircuitOpenError{}, err)
+
+	// 半开状态探测成功，关闭
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(120 * time.Millisecond)
+	_, err = get("/")
+	ast.Nil(err)
+	_, err = get("/")
+	ast.Nil(err)
+
+	// 慢请求也算失败，加上之前的一次成功共 4 个请求
+	for i := 0; i < 3; i++ {
+		_, err = get("/slow")
+		ast.Nil(err)
+	}
+	_, err = get("/")
+	ast.IsType(&ierror.CircuitOpenError{}, err)
+
+	mu.Lock()
+	ast.Equal([]string{"closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed", "closed->open"}, changes)
+	mu.Unlock()
+
+	// 调用方取消的请求不算失败
+	cancelBreaker, err := isuperagent.NewMiddleware("circuit_breaker", &isuperagent.CircuitBreakerConfig{MinRequests: 1})
+	ast.Nil(err)
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/").SetContext(canceledCtx).Middleware(cancelBreaker).Do()
+	ast.NotNil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/").Middleware(cancelBreaker).Do()
+	ast.Nil(err)
+
+	// 取消的请求不计入窗口，取消的探测请求不会关闭熔断
+	changes = nil
+	atomic.StoreInt32(&failing, 1)
+	neutralBreaker, err := isuperagent.NewMiddleware("circuit_breaker", &isuperagent.CircuitBreakerConfig{
+		MinRequests:  1,
+		FailureRatio: 0.6,
+		OpenTimeout:  50 * time.Millisecond,
+		OnStateChange: func(key, from, to string) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, from+"->"+to)
+		},
+	})
+	ast.Nil(err)
+	send := func(ctx context.Context) error {
+		_, err := isuperagent.NewRequest().Get(srv.URL + "/").SetContext(ctx).Middleware(neutralBreaker).Do()
+		return err
+	}
+	ast.NotNil(send(canceledCtx))
+	ast.Nil(send(context.Background()))
+	time.Sleep(60 * time.Millisecond)
+	ast.NotNil(send(canceledCtx))
+	ast.Nil(send(context.Background()))
+
+	mu.Lock()
+	ast.Equal([]string{"closed->open", "open->half_open", "half_open->open"}, changes)
+	mu.Unlock()
+
+	_, err = isuperagent.NewMiddleware("circuit_breaker", "config")
+	ast.NotNil(err)
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_CookieJar(t *testing.T) {
+	ast := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/", HttpOnly: true, Expires: time.Now().Add(time.Hour)})
+			http.SetCookie(w, &http.Cookie{Name: "temp", Value: "t1", Path: "/"})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", MaxAge: -1})
+		}
+
+		var names []string
+		for _, c := range r.Cookies() {
+			names = append(names, c.Name+"="+c.Value)
+		}
+		_, _ = w.Write([]byte(strings.Join(names, ";")))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "isuperagent")
+	ast.Nil(err)
+	defer os.RemoveAll(dir)
+
+	for _, store := range []isuperagent.CookieStore{
+		isuperagent.NewJsonCookieStore(filepath.Join(dir, "cookies.json")),
+		isuperagent.NewNetscapeCookieStore(filepath.Join(dir, "cookies.txt")),
+	} {
+		jar, err := isuperagent.NewCookieJar(store)
+		ast.Nil(err)
+		client := isuperagent.NewClient().SetCookieJar(jar)
+
+		// 响应的 cookie 在之后的请求中发送
+		res, err := client.NewRequest().Get(srv.URL + "/login").Do()
+		ast.Nil(err)
+		ast.Equal(2, len(res.GetCookies()))
+		ast.Equal("session", res.GetCookies()[0].Name)
+
+		res, err = client.NewRequest().Get(srv.URL + "/").SetCookie(&http.Cookie{Name: "extra", Value: "e1"}).Do()
+		ast.Nil(err)
+		ast.Equal("extra=e1;session=s1;temp=t1", string(res.GetBody().GetData()))
+
+		// 会话 cookie 不保存，重新加载后只剩持久 cookie
+		jar, err = isuperagent.NewCookieJar(store)
+		ast.Nil(err)
+		cookies := jar.AllCookies()
+		ast.Equal(1, len(cookies))
+		ast.Equal("session", cookies[0].Name)
+		ast.True(cookies[0].HttpOnly)
+		ast.True(cookies[0].HostOnly)
+
+		res, err = isuperagent.NewRequest().Get(srv.URL + "/").SetCookieJar(jar).Do()
+		ast.Nil(err)
+		ast.Equal("session=s1", string(res.GetBody().GetData()))
+
+		// 删除 cookie 后同样保存
+		_, err = isuperagent.NewRequest().Get(srv.URL + "/logout").SetCookieJar(jar).Do()
+		ast.Nil(err)
+		ast.Nil(jar.Err())
+		jar, err = isuperagent.NewCookieJar(store)
+		ast.Nil(err)
+		ast.Equal(0, len(jar.AllCookies()))
+	}
+
+	// 重复发送同一个请求，jar 中的 cookie 不会重复发送，也不会写入请求
+	jar, err := isuperagent.NewCookieJar(nil)
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/login").SetCookieJar(jar).Do()
+	ast.Nil(err)
+	req := isuperagent.NewRequest().Get(srv.URL + "/").SetCookieJar(jar)
+	for i := 0; i < 2; i++ {
+		res, err := req.Do()
+		ast.Nil(err)
+		ast.Equal("session=s1;temp=t1", string(res.GetBody().GetData()))
+	}
+	ast.Equal(0, len(req.GetCookies()))
+
+	// 不能为公共后缀设置 cookie
+	jar, err = isuperagent.NewCookieJar(nil)
+	ast.Nil(err)
+	u, _ := url.Parse("https://www.example.co.uk/")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "public", Value: "1", Domain: "co.uk"},
+		{Name: "site", Value: "1", Domain: "example.co.uk"},
+	})
+	cookies := jar.AllCookies()
+	ast.Equal(1, len(cookies))
+	ast.Equal("site", cookies[0].Name)
+	ast.Equal(".example.co.uk", cookies[0].Domain)
+
+	sub, _ := url.Parse("https://api.example.co.uk/")
+	ast.Equal(1, len(jar.Cookies(sub)))
+
+	// 读取 curl 生成的 cookies.txt
+	txt := filepath.Join(dir, "curl.txt")
+	ast.Nil(ioutil.WriteFile(txt, []byte("# Netscape HTTP Cookie File\n.example.com\tTRUE\t/\tTRUE\t4102444800\ttoken\tabc\n#HttpOnly_example.com\tFALSE\t/app\tFALSE\t0\tsid\txyz\n"), 0600))
+	jar, err = isuperagent.NewCookieJar(isuperagent.NewNetscapeCookieStore(txt))
+	ast.Nil(err)
+	u, _ = url.Parse("https://www.example.com/app/list")
+	ast.Equal(1, len(jar.Cookies(u)))
+	u, _ = url.Parse("https://example.com/app/list")
+	ast.Equal(2, len(jar.Cookies(u)))
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_Clone(t *testing.T) {
+	ast := assert.New(t)
+
+	req := isuperagent.NewRequest().Get("http://localhost/path").SetHeader("X-Name", "a").SetQuery("q", "1")
+	clone := req.Clone().SetHeader("X-Name", "b").SetQuery("q", "2")
+
+	// 副本的修改不影响原请求
+	ast.Equal([]string{"a"}, req.GetHeaders()["X-Name"])
+	ast.Equal([]string{"a", "b"}, clone.GetHeaders()["X-Name"])
+	ast.Equal(req.GetRawUrl()+"&q=2", clone.GetRawUrl())
+	ast.Equal(req.GetMethod(), clone.GetMethod())
+}
+
+func TestSuperAgent_Hedge(t *testing.T) {
+	ast := assert.New(t)
+
+	// 第一个请求很慢，之后的请求很快
+	var hits, canceled int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+				atomic.StoreInt32(&canceled, 1)
+				return
+			}
+		}
+		_, _ = w.Write([]byte(r.Method))
+	}))
+	defer srv.Close()
+
+	var attempt int
+	capture := func(ctx isuperagent.Context, next isuperagent.Next) error {
+		err := next()
+		attempt = isuperagent.GetHedgeAttempt(ctx)
+		return err
+	}
+	hedge, err := isuperagent.NewMiddleware("hedge", &isuperagent.HedgeConfig{Delay: 50 * time.Millisecond})
+	ast.Nil(err)
+
+	// 延迟后发送副本，返回先到达的响应并取消其他请求
+	start := time.Now()
+	res, err := isuperagent.NewRequest().Get(srv.URL).Middleware(capture, hedge).Do()
+	ast.Nil(err)
+	ast.Equal("GET", string(res.GetBody().GetData()))
+	ast.Equal(2, attempt)
+	ast.True(time.Since(start) < time.Second)
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+	ast.Eventually(func() bool { return atomic.LoadInt32(&canceled) == 1 }, time.Second, 5*time.Millisecond)
+
+	// 原请求足够快时不发送副本
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(capture, hedge).Do()
+	ast.Nil(err)
+	ast.Equal(1, attempt)
+	time.Sleep(80 * time.Millisecond)
+	ast.Equal(int32(3), atomic.LoadInt32(&hits))
+
+	// 副本只经过之后的中间件，之前的中间件只调用一次，不会被并发限制阻塞
+	atomic.StoreInt32(&hits, 0)
+	atomic.StoreInt32(&canceled, 0)
+	var upstream int32
+	count := func(ctx isuperagent.Context, next isuperagent.Next) error {
+		atomic.AddInt32(&upstream, 1)
+		return next()
+	}
+	bulkhead, err := isuperagent.NewMiddleware("bulkhead", &isuperagent.BulkheadConfig{MaxConcurrent: 1})
+	ast.Nil(err)
+	start = time.Now()
+	res, err = isuperagent.NewRequest().Get(srv.URL).Middleware(capture, count, bulkhead, hedge).Do()
+	ast.Nil(err)
+	ast.Equal("GET", string(res.GetBody().GetData()))
+	ast.Equal(2, attempt)
+	ast.True(time.Since(start) < time.Second)
+	ast.Equal(int32(1), atomic.LoadInt32(&upstream))
+
+	// 非幂等方法不对冲
+	atomic.StoreInt32(&hits, 0)
+	_, err = isuperagent.NewRequest().Post(srv.URL).SetTimeout(100*time.Millisecond).Middleware(capture, hedge).Do()
+	ast.NotNil(err)
+	ast.Equal(int32(1), atomic.LoadInt32(&hits))
+
+	_, err = isuperagent.NewMiddleware("hedge", &isuperagent.HedgeConfig{})
+	ast.NotNil(err)
+}
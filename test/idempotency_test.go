@@ -0,0 +1,75 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_IdempotencyKey(t *testing.T) {
+	ast := assert.New(t)
+
+	// 前两次请求断开连接，触发重试
+	var mu sync.Mutex
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		n := len(keys)
+		mu.Unlock()
+
+		if n%3 != 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+	}))
+	defer srv.Close()
+
+	var ctxKey string
+	capture := func(ctx isuperagent.Context, next isuperagent.Next) error {
+		err := next()
+		ctxKey = isuperagent.GetIdempotencyKey(ctx)
+		return err
+	}
+	idempotency, err := isuperagent.NewMiddleware("idempotency_key")
+	ast.Nil(err)
+
+	// 重试时使用相同的 key
+	req := isuperagent.NewRequest().Post(srv.URL).SetRetry(3).Middleware(capture, idempotency)
+	_, err = req.Do()
+	ast.Nil(err)
+	ast.Len(keys, 3)
+	ast.Regexp(regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), keys[0])
+	ast.Equal(keys[0], keys[1])
+	ast.Equal(keys[0], keys[2])
+	ast.Equal(keys[0], ctxKey)
+
+	// 再次发送时使用新的 key
+	_, err = req.Do()
+	ast.Nil(err)
+	ast.Len(keys, 6)
+	ast.NotEqual(keys[0], keys[3])
+	ast.Equal(keys[3], keys[5])
+
+	// 保留已设置的 key
+	_, err = isuperagent.NewRequest().Post(srv.URL).SetRetry(3).SetHeader("Idempotency-Key", "my-key").Middleware(capture, idempotency).Do()
+	ast.Nil(err)
+	ast.Equal([]string{"my-key", "my-key", "my-key"}, keys[6:])
+	ast.Equal("my-key", ctxKey)
+
+	// GET 默认不设置
+	_, err = isuperagent.NewRequest().Get(srv.URL).SetRetry(3).Middleware(capture, idempotency).Do()
+	ast.Nil(err)
+	ast.Equal("", keys[9])
+	ast.Equal("", ctxKey)
+
+	_, err = isuperagent.NewMiddleware("idempotency_key", "config")
+	ast.NotNil(err)
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_LoggerMiddleware(t *testing.T) {
+	ast := assert.New(t)
+
+	// 第一次请求断开连接，触发重试
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=abc")
+		_, _ = w.Write([]byte(`{"user":{"name":"tom","password":"p@ss"},"items":[1,2,3,4,5,6,7,8,9]}`))
+	}))
+	defer srv.Close()
+
+	var events []isuperagent.LogEvent
+	logger, err := isuperagent.NewMiddleware("logger", &isuperagent.LoggerConfig{
+		Logger:           isuperagent.LoggerFunc(func(event isuperagent.LogEvent) { events = append(events, event) }),
+		Headers:          true,
+		MaxBodySize:      40,
+		RedactQueries:    []string{"access_token"},
+		RedactJsonFields: []string{"password"},
+	})
+	ast.Nil(err)
+	bearer, err := isuperagent.NewMiddleware("bearer", "my-secret-token")
+	ast.Nil(err)
+
+	_, err = isuperagent.NewRequest().Post(srv.URL+"/users").
+		SetQuery("access_token", "t0ken").SetQuery("page", "1").
+		SetContentType("application/json").SetBody(map[string]string{"password": "123456", "name": "tom"}).
+		SetHeader("X-Api-Key", "my-secret-token").
+		SetRetry(2).Middleware(bearer, logger).Do()
+	ast.Nil(err)
+	ast.Len(events, 2)
+
+	// 请求事件，查询参数、请求头和 JSON 字段被替换
+	req := events[0]
+	ast.Equal(isuperagent.LogEventRequest, req.Event)
+	ast.Equal("POST", req.Method)
+	ast.Equal(srv.URL+"/users?access_token=[REDACTED]&page=1", req.Url)
+	ast.NotContains(req.Url, "t0ken")
+	ast.Equal(isuperagent.RedactedPlaceholder, req.Headers.Get("Authorization"))
+	ast.Equal(isuperagent.RedactedPlaceholder, req.Headers.Get("X-Api-Key"))
+	ast.Equal(`{"name":"tom","password":"[REDACTED]"}`, req.Body)
+	ast.Equal(len(`{"name":"tom","password":"123456"}`), req.Size)
+
+	// 响应事件，包含状态码、耗时、重试次数，body 被截断
+	res := events[1]
+	ast.Equal(isuperagent.LogEventResponse, res.Event)
+	ast.Equal(200, res.StatusCode)
+	ast.Equal(2, res.Attempt)
+	ast.True(res.Duration > 0)
+	ast.Nil(res.Error)
+	ast.Equal(isuperagent.RedactedPlaceholder, res.Headers.Get("Set-Cookie"))
+	ast.Equal(`{"items":[1,2,3,4,5,6,7,8,9],"user":{"na...`, res.Body)
+	ast.NotContains(res.Body, "p@ss")
+
+	// 请求失败时记录错误
+	events = nil
+	srv.Close()
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(logger).Do()
+	ast.NotNil(err)
+	ast.Len(events, 2)
+	ast.Equal(err.Error(), events[1].Error.Error())
+	ast.Equal(1, events[1].Attempt)
+
+	// 错误中的 URL 同样被替换
+	events = nil
+	apiKey, err := isuperagent.NewMiddleware("api_key", "query", "api_key", "SUPERSECRET")
+	ast.Nil(err)
+	queryLogger, err := isuperagent.NewMiddleware("logger", &isuperagent.LoggerConfig{
+		Logger:        isuperagent.LoggerFunc(func(event isuperagent.LogEvent) { events = append(events, event) }),
+		RedactQueries: []string{"token"},
+	})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get("http://127.0.0.1:1/x?token=QUERYSECRET").Middleware(apiKey, queryLogger).Do()
+	ast.NotNil(err)
+	ast.Contains(err.Error(), "SUPERSECRET")
+	ast.Len(events, 2)
+	for _, text := range []string{events[1].Error.Error(), events[1].String()} {
+		ast.NotContains(text, "SUPERSECRET")
+		ast.NotContains(text, "QUERYSECRET")
+		ast.Contains(text, "connection refused")
+	}
+	ast.Contains(events[1].Error.Error(), `"http://127.0.0.1:1/x?api_key=[REDACTED]&token=[REDACTED]"`)
+
+	// 标准库 log 适配器输出 logfmt
+	var buf bytes.Buffer
+	std := isuperagent.NewStdLogger(log.New(&buf, "", 0))
+	std.Log(isuperagent.LogEvent{Event: isuperagent.LogEventResponse, Method: "GET", Url: "http://localhost/", StatusCode: 200, Attempt: 1, Error: err})
+	line := buf.String()
+	ast.True(strings.HasPrefix(line, "event=response method=GET url=http://localhost/ status=200 duration=0s attempt=1 size=0 error=\""))
+
+	_, err = isuperagent.NewMiddleware("logger", "config")
+	ast.NotNil(err)
+}
+
+func TestSuperAgent_DebugMiddlewareWithoutCallback(t *testing.T) {
+	ast := assert.New(t)
+
+	// 不传回调时不会 panic
+	debug, err := isuperagent.NewMiddleware("debug")
+	ast.Nil(err)
+	ast.NotNil(debug)
+}
@@ -0,0 +1,424 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/charleslxh/isuperagent"
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSuperAgent_DigestAuthMiddleware(t *testing.T) {
+	ast := assert.New(t)
+
+	var challenges, ncs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		for _, m := range regexp.MustCompile(`(\w+)="?([^",]*)"?`).FindAllStringSubmatch(r.Header.Get("Authorization"), -1) {
+			params[m[1]] = m[2]
+		}
+
+		ha1 := md5Hex("user:testrealm:pass")
+		ha2 := md5Hex(r.Method + ":" + r.URL.RequestURI())
+		excepted := md5Hex(ha1 + ":nonce1:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["response"] != excepted || params["uri"] != r.URL.RequestURI() {
+			challenges = append(challenges, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Digest realm="testrealm", qop="auth,auth-int", nonce="nonce1", opaque="opaque1"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ncs = append(ncs, params["nc"])
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	digestMiddleware, err := isuperagent.NewMiddleware("digest_auth", "user", "pass")
+	ast.Nil(err)
+
+	client := isuperagent.NewClient().Middleware(digestMiddleware)
+
+	// 第一次请求收到 401 后带上认证信息重新发送，请求体也重新发送
+	res, err := client.NewRequest().Post(srv.URL+"/echo?a=1", "Hello World").Do()
+	ast.Nil(err)
+	ast.Equal(200, res.GetStatusCode())
+	ast.Equal("Hello World", string(res.GetBody().GetData()))
+
+	// 之后的请求直接带上认证信息，nonce count 递增
+	res, err = client.NewRequest().Get(srv.URL + "/b").Do()
+	ast.Nil(err)
+	ast.Equal(200, res.GetStatusCode())
+
+	ast.Equal([]string{"/echo"}, challenges)
+	ast.Equal([]string{"00000001", "00000002"}, ncs)
+
+	// 密码错误
+	wrongMiddleware, err := isuperagent.NewMiddleware("digest_auth", "user", "wrong")
+	ast.Nil(err)
+	res, err = isuperagent.NewRequest().Get(srv.URL).Middleware(wrongMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal(401, res.GetStatusCode())
+
+	_, err = isuperagent.NewMiddleware("digest_auth", "user")
+	ast.NotNil(err)
+	ast.Equal("excepted two arguments, the first is username, next is password", err.Error())
+}
+
+func TestSuperAgent_OAuth2Middleware(t *testing.T) {
+	ast := assert.New(t)
+
+	var mu sync.Mutex
+	var grants []string
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		ast.Nil(r.ParseForm())
+
+		mu.Lock()
+		grants = append(grants, r.PostForm.Get("grant_type"))
+		n := len(grants)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if user != "id" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"access_token":"token%d","token_type":"bearer","expires_in":3600,"refresh_token":"refresh%d"}`, n, n)))
+	}))
+	defer tokenSrv.Close()
+
+	var revoked int32
+	apiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer token1" && atomic.LoadInt32(&revoked) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer apiSrv.Close()
+
+	oauth2Middleware, err := isuperagent.NewMiddleware("oauth2", &isuperagent.OAuth2Config{
+		TokenUrl:     tokenSrv.URL,
+		ClientId:     "id",
+		ClientSecret: "secret",
+		Scopes:       []string{"read"},
+	})
+	ast.Nil(err)
+	client := isuperagent.NewClient().Middleware(oauth2Middleware)
+
+	// 并发请求只获取一次 token
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.NewRequest().Get(apiSrv.URL).Do()
+			ast.Nil(err)
+			ast.Equal("Bearer token1", string(res.GetBody().GetData()))
+		}()
+	}
+	wg.Wait()
+	ast.Equal([]string{"client_credentials"}, grants)
+
+	// token 失效后使用 refresh token 刷新并重试一次
+	atomic.StoreInt32(&revoked, 1)
+	res, err := client.NewRequest().Get(apiSrv.URL).Do()
+	ast.Nil(err)
+	ast.Equal("Bearer token2", string(res.GetBody().GetData()))
+	ast.Equal([]string{"client_credentials", "refresh_token"}, grants)
+
+	// token 接口返回错误
+	wrongMiddleware, err := isuperagent.NewMiddleware("oauth2", &isuperagent.OAuth2Config{TokenUrl: tokenSrv.URL, ClientId: "id"})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(apiSrv.URL).Middleware(wrongMiddleware).Do()
+	oauth2Err, ok := err.(*ierror.OAuth2Error)
+	ast.True(ok)
+	ast.Equal("invalid_client", oauth2Err.ErrorCode)
+}
+
+func TestSuperAgent_BearerAndApiKeyMiddleware(t *testing.T) {
+	ast := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization") + "|" + r.Header.Get("X-Api-Key") + "|" + r.URL.Query().Get("api_key")))
+	}))
+	defer srv.Close()
+
+	// 从文件读取 token，文件修改后重新读取
+	dir, err := ioutil.TempDir("", "isuperagent")
+	ast.Nil(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ast.Nil(ioutil.WriteFile(tokenFile, []byte("token1\n"), 0600))
+
+	bearerMiddleware, err := isuperagent.NewMiddleware("bearer", isuperagent.NewFileToken(tokenFile))
+	ast.Nil(err)
+
+	var debugAuthorization, debugUrl string
+	debugMiddleware, err := isuperagent.NewMiddleware("debug", func(ctx isuperagent.Context) {
+		debugAuthorization = ctx.GetReq().GetHeader("Authorization")
+		debugUrl = ctx.GetReq().GetRawUrl()
+	})
+	ast.Nil(err)
+
+	res, err := isuperagent.NewRequest().Get(srv.URL).Middleware(bearerMiddleware, debugMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal("Bearer token1||", string(res.GetBody().GetData()))
+	ast.Equal("Bearer [REDACTED]", debugAuthorization)
+
+	ast.Nil(ioutil.WriteFile(tokenFile, []byte("token2"), 0600))
+	ast.Nil(os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Second)))
+	res, err = isuperagent.NewRequest().Get(srv.URL).Middleware(bearerMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal("Bearer token2||", string(res.GetBody().GetData()))
+
+	// 从环境变量读取 api key，通过请求头发送
+	ast.Nil(os.Setenv("ISUPERAGENT_TEST_API_KEY", "key1"))
+	defer os.Unsetenv("ISUPERAGENT_TEST_API_KEY")
+	headerMiddleware, err := isuperagent.NewMiddleware("api_key", "header", "X-Api-Key", isuperagent.EnvToken("ISUPERAGENT_TEST_API_KEY"))
+	ast.Nil(err)
+	res, err = isuperagent.NewRequest().Get(srv.URL).Middleware(headerMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal("|key1|", string(res.GetBody().GetData()))
+
+	// 通过查询参数发送，调试输出的 url 中同样脱敏
+	queryMiddleware, err := isuperagent.NewMiddleware("api_key", "query", "api_key", "key2")
+	ast.Nil(err)
+	res, err = isuperagent.NewRequest().Get(srv.URL).Middleware(queryMiddleware, debugMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal("||key2", string(res.GetBody().GetData()))
+	ast.NotContains(debugUrl, "key2")
+
+	// 环境变量为空
+	emptyMiddleware, err := isuperagent.NewMiddleware("bearer", isuperagent.EnvToken("ISUPERAGENT_TEST_EMPTY"))
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(emptyMiddleware).Do()
+	ast.NotNil(err)
+
+	_, err = isuperagent.NewMiddleware("api_key", "cookie", "name", "key")
+	ast.NotNil(err)
+}
+
+func TestSuperAgent_HmacSignMiddleware(t *testing.T) {
+	ast := assert.New(t)
+
+	var received *http.Request
+	var receivedBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	hmacMiddleware, err := isuperagent.NewMiddleware("hmac_sign", &isuperagent.HmacSignConfig{Secret: "secret"})
+	ast.Nil(err)
+
+	// 之后的中间件修改的请求体和查询参数同样被签名
+	changeMiddleware := func(ctx isuperagent.Context, next isuperagent.Next) error {
+		ctx.GetReq().SetQuery("b", "2").SetBody(map[string]string{"name": "changed"})
+		return next()
+	}
+
+	_, err = isuperagent.NewRequest().Post(srv.URL+"/api/items?c=3&a=1", map[string]string{"name": "origin"}).SetContentType("application/json").
+		Middleware(hmacMiddleware, changeMiddleware).Do()
+	ast.Nil(err)
+	ast.Equal(`{"name":"changed"}`, string(receivedBody))
+
+	bodyHash := sha256.Sum256(receivedBody)
+	canonical := strings.Join([]string{
+		"POST",
+		"/api/items",
+		"a=1&b=2&c=3",
+		hex.EncodeToString(bodyHash[:]),
+		received.Header.Get("X-Timestamp"),
+		received.Header.Get("X-Nonce"),
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(canonical))
+	ast.Equal(hex.EncodeToString(mac.Sum(nil)), received.Header.Get("X-Signature"))
+	ast.NotEmpty(received.Header.Get("X-Nonce"))
+
+	// SHA-1、base64 编码，签名放在查询参数中
+	queryMiddleware, err := isuperagent.NewMiddleware("hmac_sign", &isuperagent.HmacSignConfig{
+		Secret:     "secret",
+		Components: []string{isuperagent.HmacSignTimestamp, isuperagent.HmacSignMethod, "header:X-App-Id", isuperagent.HmacSignQuery},
+		Separator:  "|",
+		Hash:       isuperagent.HmacSha1,
+		Encoding:   isuperagent.HmacEncodingBase64,
+		In:         "query",
+		Name:       "sign",
+		Prefix:     "v1:",
+	})
+	ast.Nil(err)
+
+	_, err = isuperagent.NewRequest().Get(srv.URL+"/api/items?x=1").SetHeader("X-App-Id", "app").Middleware(queryMiddleware).Do()
+	ast.Nil(err)
+
+	query := received.URL.Query()
+	mac = hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(query.Get("X-Timestamp") + "|GET|app|X-Timestamp=" + query.Get("X-Timestamp") + "&x=1"))
+	ast.Equal("v1:"+base64.StdEncoding.EncodeToString(mac.Sum(nil)), query.Get("sign"))
+
+	// 查询参数在时间戳和 nonce 之前，签名的查询参数同样包含时间戳和 nonce
+	queryFirstMiddleware, err := isuperagent.NewMiddleware("hmac_sign", &isuperagent.HmacSignConfig{
+		Secret:     "secret",
+		Components: []string{isuperagent.HmacSignQuery, isuperagent.HmacSignTimestamp, isuperagent.HmacSignNonce},
+		In:         "query",
+		Name:       "sign",
+	})
+	ast.Nil(err)
+
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/api/items?x=1").Middleware(queryFirstMiddleware).Do()
+	ast.Nil(err)
+
+	query = received.URL.Query()
+	mac = hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("X-Nonce=" + query.Get("X-Nonce") + "&X-Timestamp=" + query.Get("X-Timestamp") + "&x=1\n" + query.Get("X-Timestamp") + "\n" + query.Get("X-Nonce")))
+	ast.Equal(hex.EncodeToString(mac.Sum(nil)), query.Get("sign"))
+
+	_, err = isuperagent.NewMiddleware("hmac_sign", &isuperagent.HmacSignConfig{Secret: "secret", Hash: "md4"})
+	ast.NotNil(err)
+	ast.Equal("unsupported hmac hash md4", err.Error())
+}
+
+// 解析并校验 JWT，返回 header 和 claims
+func parseJwt(ast *assert.Assertions, token string, verify func(signingInput, signature []byte) bool) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	ast.Equal(3, len(parts))
+
+	headerJson, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	ast.True(verify([]byte(parts[0]+"."+parts[1]), signature))
+
+	var header, claims map[string]interface{}
+	ast.Nil(json.Unmarshal(headerJson, &header))
+	ast.Nil(json.Unmarshal(claimsJson, &claims))
+
+	return header, claims
+}
+
+func TestSuperAgent_JwtMiddleware(t *testing.T) {
+	ast := assert.New(t)
+
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}))
+	defer srv.Close()
+
+	hsMiddleware, err := isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{
+		Key:     "secret",
+		KeyId:   "key1",
+		Issuer:  "service-a",
+		Subject: "client",
+		TTL:     2 * time.Second,
+		Claims:  map[string]interface{}{"scope": "read"},
+	})
+	ast.Nil(err)
+
+	// token 缓存至即将过期
+	for i := 0; i < 2; i++ {
+		_, err = isuperagent.NewRequest().Get(srv.URL + "/api").Middleware(hsMiddleware).Do()
+		ast.Nil(err)
+	}
+	ast.Equal(tokens[0], tokens[1])
+
+	header, claims := parseJwt(ast, tokens[0], func(signingInput, signature []byte) bool {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(signingInput)
+		return hmac.Equal(mac.Sum(nil), signature)
+	})
+	ast.Equal("HS256", header["alg"])
+	ast.Equal("key1", header["kid"])
+	ast.Equal("service-a", claims["iss"])
+	ast.Equal("client", claims["sub"])
+	ast.Equal(srv.URL, claims["aud"])
+	ast.Equal("read", claims["scope"])
+	ast.NotEmpty(claims["jti"])
+	ast.Equal(claims["iat"].(float64)+2, claims["exp"])
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/api").Middleware(hsMiddleware).Do()
+	ast.Nil(err)
+	ast.NotEqual(tokens[0], tokens[2])
+
+	// RS256，私钥为 PEM 格式
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ast.Nil(err)
+	rsaPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	rsMiddleware, err := isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{Algorithm: isuperagent.JwtRS256, Key: rsaPem, Audience: "gateway"})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(rsMiddleware).Do()
+	ast.Nil(err)
+	_, claims = parseJwt(ast, tokens[3], func(signingInput, signature []byte) bool {
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+	})
+	ast.Equal("gateway", claims["aud"])
+
+	// ES256
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ast.Nil(err)
+	esMiddleware, err := isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{Algorithm: isuperagent.JwtES256, Key: ecKey})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(esMiddleware).Do()
+	ast.Nil(err)
+	parseJwt(ast, tokens[4], func(signingInput, signature []byte) bool {
+		digest := sha256.Sum256(signingInput)
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return len(signature) == 64 && ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s)
+	})
+
+	// EdDSA
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	ast.Nil(err)
+	edMiddleware, err := isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{Algorithm: isuperagent.JwtEdDSA, Key: edKey})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(edMiddleware).Do()
+	ast.Nil(err)
+	parseJwt(ast, tokens[5], func(signingInput, signature []byte) bool {
+		return ed25519.Verify(edPublic, signingInput, signature)
+	})
+
+	// 密钥与算法不匹配
+	_, err = isuperagent.NewMiddleware("jwt", &isuperagent.JwtConfig{Algorithm: isuperagent.JwtRS256, Key: ecKey})
+	ast.NotNil(err)
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+func TestSuperAgent_RateLimit(t *testing.T) {
+	ast := assert.New(t)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/exhausted":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "1")
+		case "/too-many":
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	// 超出 burst 后按速率等待
+	limit, err := isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 20, Burst: 2})
+	ast.Nil(err)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := isuperagent.NewRequest().Get(srv.URL).Middleware(limit).Do()
+		ast.Nil(err)
+	}
+	ast.True(time.Since(start) >= 90*time.Millisecond)
+
+	// 快速失败
+	limit, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 1, FailFast: true})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(limit).Do()
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(limit).Do()
+	ast.IsType(&ierror.RateLimitError{}, err)
+	ast.True(err.(*ierror.RateLimitError).RetryAfter > 0)
+
+	// 等待时 context 取消
+	limit, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 0.1})
+	ast.Nil(err)
+	_, err = isuperagent.NewRequest().Get(srv.URL).Middleware(limit).Do()
+	ast.Nil(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = isuperagent.NewRequest().Get(srv.URL).SetContext(ctx).Middleware(limit).Do()
+	ast.Equal(context.DeadlineExceeded, err)
+
+	// 按路径前缀限流，未匹配的请求不限流
+	limit, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{
+		Rate: 1, FailFast: true, Key: isuperagent.KeyByPathPrefix("/a", "/b"),
+	})
+	ast.Nil(err)
+	for _, path := range []string{"/a/1", "/b/1", "/c", "/c"} {
+		_, err = isuperagent.NewRequest().Get(srv.URL + path).Middleware(limit).Do()
+		ast.Nil(err)
+	}
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/a/2").Middleware(limit).Do()
+	ast.NotNil(err)
+
+	// 服务端告知额度用完，等到重置时间
+	for _, path := range []string{"/exhausted", "/too-many"} {
+		limit, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 100, Burst: 10, FailFast: true})
+		ast.Nil(err)
+		_, err = isuperagent.NewRequest().Get(srv.URL + path).Middleware(limit).Do()
+		ast.Nil(err)
+		_, err = isuperagent.NewRequest().Get(srv.URL + path).Middleware(limit).Do()
+		if ast.IsType(&ierror.RateLimitError{}, err, path) {
+			ast.True(err.(*ierror.RateLimitError).RetryAfter > 500*time.Millisecond, path)
+		}
+	}
+
+	// 忽略服务端提示
+	limit, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{Rate: 100, Burst: 10, FailFast: true, IgnoreServerHints: true})
+	ast.Nil(err)
+	before := atomic.LoadInt32(&hits)
+	for i := 0; i < 2; i++ {
+		_, err = isuperagent.NewRequest().Get(srv.URL + "/too-many").Middleware(limit).Do()
+		ast.Nil(err)
+	}
+	ast.Equal(before+2, atomic.LoadInt32(&hits))
+
+	_, err = isuperagent.NewMiddleware("rate_limit", &isuperagent.RateLimitConfig{})
+	ast.NotNil(err)
+}
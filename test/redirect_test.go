@@ -0,0 +1,118 @@
+package test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_Redirects(t *testing.T) {
+	ast := assert.New(t)
+
+	// 其他主机，记录收到的 Authorization
+	var otherAuthorization string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuthorization = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/hop/"):
+			// /hop/3 -> /hop/2 -> /hop/1 -> /final
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+			location := "/final"
+			if n > 1 {
+				location = "/hop/" + strconv.Itoa(n-1)
+			}
+			http.Redirect(w, r, location, http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/status/"):
+			code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+			http.Redirect(w, r, "/final", code)
+		case r.URL.Path == "/other":
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			_, _ = w.Write([]byte(r.Method + " " + string(body)))
+		}
+	}))
+	defer srv.Close()
+
+	// 记录每一跳的 URL 和状态码
+	res, err := isuperagent.NewRequest().Get(srv.URL + "/hop/3").Do()
+	ast.Nil(err)
+	ast.Equal("GET ", string(res.GetBody().GetData()))
+	ast.Equal([]isuperagent.Redirect{
+		{Url: srv.URL + "/hop/3", StatusCode: 302},
+		{Url: srv.URL + "/hop/2", StatusCode: 302},
+		{Url: srv.URL + "/hop/1", StatusCode: 302},
+	}, res.GetRedirects())
+
+	// 超过重定向次数
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/hop/3").Redirects(2).Do()
+	ast.NotNil(err)
+	ast.Contains(err.Error(), "stopped after 2 redirects")
+
+	// 不跟随重定向，返回 3xx 响应
+	res, err = isuperagent.NewRequest().Get(srv.URL + "/hop/3").Redirects(0).Do()
+	ast.Nil(err)
+	ast.Equal(302, res.GetStatusCode())
+	ast.Equal("/hop/2", res.GetHeaders().Get("Location"))
+	ast.Empty(res.GetRedirects())
+
+	// 自定义策略
+	res, err = isuperagent.NewRequest().Get(srv.URL + "/hop/3").SetRedirectPolicy(func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/hop/1" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}).Do()
+	ast.Nil(err)
+	ast.Equal(302, res.GetStatusCode())
+	ast.Equal(1, len(res.GetRedirects()))
+
+	_, err = isuperagent.NewRequest().Get(srv.URL + "/hop/1").SetRedirectPolicy(func(req *http.Request, via []*http.Request) error {
+		return errors.New("redirect denied")
+	}).Do()
+	ast.NotNil(err)
+	ast.Contains(err.Error(), "redirect denied")
+
+	// 方法改写规则
+	for _, c := range []struct {
+		code     int
+		rule     isuperagent.RedirectMethodRule
+		excepted string
+	}{
+		{301, nil, "GET "},
+		{302, nil, "GET "},
+		{303, nil, "GET "},
+		{307, nil, "POST data"},
+		{308, nil, "POST data"},
+		{301, isuperagent.RedirectMethodStrict, "POST data"},
+		{302, isuperagent.RedirectMethodStrict, "POST data"},
+		{303, isuperagent.RedirectMethodStrict, "GET "},
+		{307, func(code int, method string) string { return http.MethodGet }, "GET "},
+	} {
+		res, err = isuperagent.NewRequest().Post(srv.URL+"/status/"+strconv.Itoa(c.code), "data").SetRedirectMethodRule(c.rule).Do()
+		ast.Nil(err)
+		ast.Equal(c.excepted, string(res.GetBody().GetData()), "status %d", c.code)
+	}
+
+	// 跨主机时 Authorization 的处理，client 的配置被请求覆盖
+	client := isuperagent.NewClient().SetRedirectAuth(isuperagent.RedirectAuthKeep)
+	_, err = client.NewRequest().Get(srv.URL+"/other").SetHeader("Authorization", "Bearer token").Do()
+	ast.Nil(err)
+	ast.Equal("Bearer token", otherAuthorization)
+
+	_, err = client.NewRequest().Get(srv.URL+"/other").SetHeader("Authorization", "Bearer token").SetRedirectAuth(isuperagent.RedirectAuthSameHost).Do()
+	ast.Nil(err)
+	ast.Equal("", otherAuthorization)
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/charleslxh/isuperagent"
+)
+
+func TestSuperAgent_SingleFlight(t *testing.T) {
+	ast := assert.New(t)
+
+	// 服务端延迟响应，保证请求同时在途
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("X-Token", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("shared"))
+	}))
+	defer srv.Close()
+
+	singleflight, err := isuperagent.NewMiddleware("singleflight", &isuperagent.SingleFlightConfig{Headers: []string{"Authorization"}})
+	ast.Nil(err)
+
+	run := func(n int, method, token string) ([]isuperagent.Response, []bool) {
+		var wg sync.WaitGroup
+		responses := make([]isuperagent.Response, n)
+		shared := make([]bool, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				capture := func(ctx isuperagent.Context, next isuperagent.Next) error {
+					err := next()
+					shared[i] = isuperagent.IsSharedResponse(ctx)
+					return err
+				}
+				res, err := isuperagent.NewRequest().SetMethod(method, srv.URL).SetHeader("Authorization", token).Middleware(capture, singleflight).Do()
+				ast.Nil(err)
+				responses[i] = res
+			}(i)
+		}
+		wg.Wait()
+		return responses, shared
+	}
+
+	// 相同的请求只发送一次，其余请求得到响应的副本
+	responses, shared := run(5, "GET", "a")
+	ast.Equal(int32(1), atomic.LoadInt32(&hits))
+	sharedCount := 0
+	for i, res := range responses {
+		ast.Equal("shared", string(res.GetBody().GetData()))
+		if shared[i] {
+			sharedCount++
+		}
+	}
+	ast.Equal(4, sharedCount)
+
+	// 副本相互独立
+	responses[0].GetHeaders().Set("X-Token", "changed")
+	ast.Equal("a", responses[1].GetHeaders().Get("X-Token"))
+
+	// 请求头不同不共享
+	atomic.StoreInt32(&hits, 0)
+	var wg sync.WaitGroup
+	for _, token := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			responses, _ := run(2, "GET", token)
+			ast.Equal(token, responses[0].GetHeaders().Get("X-Token"))
+		}(token)
+	}
+	wg.Wait()
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+
+	// 默认不共享凭证不同的请求
+	atomic.StoreInt32(&hits, 0)
+	defaultSingleflight, err := isuperagent.NewMiddleware("singleflight")
+	ast.Nil(err)
+	tokens := []string{"Bearer a", "Bearer b"}
+	responses = make([]isuperagent.Response, len(tokens))
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			res, err := isuperagent.NewRequest().Get(srv.URL).SetHeader("Authorization", token).Middleware(defaultSingleflight).Do()
+			ast.Nil(err)
+			responses[i] = res
+		}(i, token)
+	}
+	wg.Wait()
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+	for i, token := range tokens {
+		ast.Equal(token, responses[i].GetHeaders().Get("X-Token"))
+	}
+
+	// 非安全方法不共享
+	atomic.StoreInt32(&hits, 0)
+	run(3, "POST", "a")
+	ast.Equal(int32(3), atomic.LoadInt32(&hits))
+
+	// 之前的中间件修改响应时，其余请求得到的副本不受影响
+	atomic.StoreInt32(&hits, 0)
+	requestTime, err := isuperagent.NewMiddleware("request_time")
+	ast.Nil(err)
+	var rwg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			res, err := isuperagent.NewRequest().Get(srv.URL).SetHeader("Authorization", "a").Middleware(requestTime, singleflight).Do()
+			ast.Nil(err)
+			ast.Equal(1, len(res.GetHeaders()["X-Superagent-Duration"]))
+		}()
+	}
+	rwg.Wait()
+	ast.Equal(int32(1), atomic.LoadInt32(&hits))
+
+	// 发送的请求被取消时，其余请求自己发送
+	atomic.StoreInt32(&hits, 0)
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, err := isuperagent.NewRequest().Get(srv.URL).SetHeader("Authorization", "c").SetContext(leaderCtx).Middleware(singleflight).Do()
+		leaderDone <- err
+	}()
+	time.AfterFunc(50*time.Millisecond, cancel)
+	time.Sleep(10 * time.Millisecond)
+
+	var followerShared bool
+	capture := func(ctx isuperagent.Context, next isuperagent.Next) error {
+		err := next()
+		followerShared = isuperagent.IsSharedResponse(ctx)
+		return err
+	}
+	res, err := isuperagent.NewRequest().Get(srv.URL).SetHeader("Authorization", "c").Middleware(capture, singleflight).Do()
+	ast.Nil(err)
+	ast.Equal("shared", string(res.GetBody().GetData()))
+	ast.False(followerShared)
+	ast.NotNil(<-leaderDone)
+	ast.Equal(int32(2), atomic.LoadInt32(&hits))
+
+	_, err = isuperagent.NewMiddleware("singleflight", "config")
+	ast.NotNil(err)
+}
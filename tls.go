@@ -0,0 +1,83 @@
+package isuperagent
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+// VerifyPeerFunc verifies the certificates presented by server, the first is the leaf certificate.
+// The certificates are already verified by the CAs unless InsecureSkipVerify is true.
+type VerifyPeerFunc func(certs []*x509.Certificate) error
+
+// The prefix of SPKI SHA-256 pin
+const PinPrefix = "sha256/"
+
+// Get the SPKI SHA-256 pin of the certificate, such as sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+// Same as: openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return PinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Create the tls.Config.VerifyPeerCertificate to check pins and call the verify peer callback.
+// The connection is accepted if any certificate of chain matches any pin, so the backup pins
+// of the keys not deployed yet can be added together.
+func newPeerVerifier(pins []string, verify VerifyPeerFunc) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		if len(pins) > 0 {
+			if err := checkPins(pins, certs, verifiedChains); err != nil {
+				return err
+			}
+		}
+
+		if verify != nil {
+			return verify(certs)
+		}
+
+		return nil
+	}
+}
+
+func checkPins(pins []string, certs []*x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+	pinSet := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinSet[pin] = true
+	}
+
+	// the verified chains include the root CA which is not sent by server
+	chains := verifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{certs}
+	}
+
+	var peerPins []string
+	seen := map[string]bool{}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := PublicKeyPin(cert)
+			if pinSet[pin] {
+				return nil
+			}
+
+			if !seen[pin] {
+				seen[pin] = true
+				peerPins = append(peerPins, pin)
+			}
+		}
+	}
+
+	return &ierror.PinningError{Pins: pins, PeerPins: peerPins}
+}
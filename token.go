@@ -0,0 +1,178 @@
+package isuperagent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides the token of bearer and api_key middlewares.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenSourceFunc is an adapter to use a function as TokenSource.
+type TokenSourceFunc func() (string, error)
+
+func (fn TokenSourceFunc) Token() (string, error) {
+	return fn()
+}
+
+// StaticToken is a token which never changes.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// EnvToken reads the token from the environment variable for every request.
+type EnvToken string
+
+func (t EnvToken) Token() (string, error) {
+	token := os.Getenv(string(t))
+	if token == "" {
+		return "", errors.New(fmt.Sprintf("environment variable %s is empty", string(t)))
+	}
+
+	return token, nil
+}
+
+// FileToken reads the token from file, the file is read again after it is changed.
+// The leading and trailing white spaces of file content are trimmed.
+type FileToken struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+func NewFileToken(path string) *FileToken {
+	return &FileToken{Path: path}
+}
+
+func (t *FileToken) Token() (string, error) {
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && info.ModTime().Equal(t.modTime) {
+		return t.token, nil
+	}
+
+	bs, err := ioutil.ReadFile(t.Path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(bs))
+	if token == "" {
+		return "", errors.New(fmt.Sprintf("token file %s is empty", t.Path))
+	}
+	t.token = token
+	t.modTime = info.ModTime()
+
+	return t.token, nil
+}
+
+// Get the token source of middleware argument, it can be a string or a TokenSource.
+func toTokenSource(v interface{}) (TokenSource, error) {
+	switch t := v.(type) {
+	case string:
+		return StaticToken(t), nil
+	case TokenSource:
+		return t, nil
+	case func() (string, error):
+		return TokenSourceFunc(t), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("excepted token is string or isuperagent.TokenSource, but got %v(%s)", v, reflect.TypeOf(v)))
+	}
+}
+
+// Middleware: Bearer token auth
+//
+// The token is sent by the Authorization header, such as: Authorization: Bearer xxxxx
+// The first argument is the token, it can be a string or an isuperagent.TokenSource,
+// such as isuperagent.EnvToken("API_TOKEN") or isuperagent.NewFileToken("/var/run/secrets/token").
+// The token is redacted in the output of debug middleware.
+func NewBearerMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 1 {
+		return nil, errors.New("excepted first argument is the token")
+	}
+
+	source, err := toTokenSource(v[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx Context, next Next) error {
+		token, err := source.Token()
+		if err != nil {
+			return err
+		}
+
+		AddSecrets(ctx, token)
+		ctx.GetReq().GetHeaders().Set("Authorization", "Bearer "+token)
+
+		return next()
+	}, nil
+}
+
+// The places of api key
+const (
+	ApiKeyInHeader = "header"
+	ApiKeyInQuery  = "query"
+)
+
+// Middleware: API key auth
+//
+// The arguments are:
+// 1. Where to send the api key, "header" or "query".
+// 2. The name of header or query parameter, such as X-Api-Key.
+// 3. The api key, it can be a string or an isuperagent.TokenSource.
+// The api key is redacted in the output of debug middleware.
+func NewApiKeyMiddlewareFactory(v ...interface{}) (Middleware, error) {
+	if len(v) < 3 {
+		return nil, errors.New("excepted three arguments, the first is header or query, next is the name, the last is the api key")
+	}
+
+	in, ok := v[0].(string)
+	if !ok || (in != ApiKeyInHeader && in != ApiKeyInQuery) {
+		return nil, errors.New(fmt.Sprintf("excepted first argument is header or query, but got %v(%s)", v[0], reflect.TypeOf(v[0])))
+	}
+
+	name, ok := v[1].(string)
+	if !ok || name == "" {
+		return nil, errors.New(fmt.Sprintf("excepted name is non-empty string, but got %v(%s)", v[1], reflect.TypeOf(v[1])))
+	}
+
+	source, err := toTokenSource(v[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx Context, next Next) error {
+		token, err := source.Token()
+		if err != nil {
+			return err
+		}
+
+		AddSecrets(ctx, token)
+		if in == ApiKeyInHeader {
+			ctx.GetReq().GetHeaders().Set(name, token)
+		} else {
+			ctx.GetReq().GetQueries().Set(name, token)
+		}
+
+		return next()
+	}, nil
+}
@@ -0,0 +1,230 @@
+package isuperagent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	ierror "github.com/charleslxh/isuperagent/error"
+)
+
+// The default timeouts of the transport, same as http.DefaultTransport.
+// They are used when the timeout is not set on both of request and client.
+const (
+	DefaultDialTimeout           = 30 * time.Second
+	DefaultKeepAlive             = 30 * time.Second
+	DefaultTlsHandshakeTimeout   = 10 * time.Second
+	DefaultExpectContinueTimeout = 1 * time.Second
+	DefaultIdleConnTimeout       = 90 * time.Second
+)
+
+// Create the http.Transport used to send the request.
+func newTransport(r Request) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   durationOrDefault(r.GetDialTimeout(), DefaultDialTimeout),
+		KeepAlive: DefaultKeepAlive,
+	}
+
+	dial := r.GetDialContext()
+	if dial == nil {
+		dial = dialer.DialContext
+	}
+	dial = resolveDial(dial, r.GetResolves(), r.GetResolver())
+
+	proxy, err := newProxyFunc(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			// never proxy the requests over unix socket
+			if getUnixSocket(req.Context()) != "" {
+				return nil, nil
+			}
+
+			return proxy(req)
+		},
+		DialContext:           dialUnixSocket(dial),
+		MaxIdleConns:          100,
+		TLSHandshakeTimeout:   durationOrDefault(r.GetTlsHandshakeTimeout(), DefaultTlsHandshakeTimeout),
+		ResponseHeaderTimeout: r.GetResponseHeaderTimeout(),
+		ExpectContinueTimeout: durationOrDefault(r.GetExpectContinueTimeout(), DefaultExpectContinueTimeout),
+		IdleConnTimeout:       durationOrDefault(r.GetIdleConnTimeout(), DefaultIdleConnTimeout),
+	}
+
+	tlsConfig, err := newTlsConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	tr.TLSClientConfig = tlsConfig
+
+	// HTTP/2 is negotiated by ALPN, an empty TLSNextProto disables it.
+	// The transport with custom dialer and tls config does not enable HTTP/2 by itself, configure it explicitly,
+	// unless the ALPN protocols are set by the tls config of user without h2.
+	if r.GetHttp2() && allowHttp2(tlsConfig.NextProtos) {
+		if err := http2.ConfigureTransport(tr); err != nil {
+			return nil, err
+		}
+	} else {
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return tr, nil
+}
+
+// Create the tls config by the https options of request.
+func newTlsConfig(r Request) (*tls.Config, error) {
+	// The options are merged into a copy of the tls config of user, the config of user is never changed
+	tlsConfig := &tls.Config{}
+	if c := r.GetTlsConfig(); c != nil {
+		tlsConfig = c.Clone()
+	}
+
+	if r.GetInsecureSkipVerify() {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	// set tls versions, cipher suites, curves and SNI
+	if v := r.GetTlsMinVersion(); v != 0 {
+		tlsConfig.MinVersion = v
+	}
+	if v := r.GetTlsMaxVersion(); v != 0 {
+		tlsConfig.MaxVersion = v
+	}
+	if suites := r.GetCipherSuites(); len(suites) > 0 {
+		tlsConfig.CipherSuites = suites
+	}
+	if curves := r.GetCurvePreferences(); len(curves) > 0 {
+		tlsConfig.CurvePreferences = curves
+	}
+	if name := r.GetServerName(); name != "" {
+		tlsConfig.ServerName = name
+	}
+
+	// Add server's root ca cert, verify the server certificate
+	pool, err := r.GetRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		tlsConfig.RootCAs = pool
+	}
+
+	// Set client certificate
+	certs, err := r.GetClientCertificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) > 0 {
+		tlsConfig.Certificates = certs
+	}
+
+	// The client certificate may be reloaded, get the current one for every handshake
+	if ir, ok := r.(*irequest); ok && ir.Client != nil && ir.Client.reloader != nil && !ir.hasClientCerts() {
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = ir.Client.reloader.getClientCertificate
+	}
+
+	// Pin the public keys and verify the server certificates by user
+	if pins, verify := r.GetPublicKeyPins(), r.GetVerifyPeer(); len(pins) > 0 || verify != nil {
+		verifyPeerCertificate := newPeerVerifier(pins, verify)
+
+		// VerifyPeerCertificate is not called on the resumed sessions, always do the full handshake
+		tlsConfig.ClientSessionCache = nil
+
+		// keep the verification of user's tls config
+		if userVerify := tlsConfig.VerifyPeerCertificate; userVerify != nil {
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				if err := userVerify(rawCerts, verifiedChains); err != nil {
+					return err
+				}
+
+				return verifyPeerCertificate(rawCerts, verifiedChains)
+			}
+		} else {
+			tlsConfig.VerifyPeerCertificate = verifyPeerCertificate
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Whether HTTP/2 can be added to the ALPN protocols, the protocols set by user are kept as is.
+func allowHttp2(nextProtos []string) bool {
+	if len(nextProtos) == 0 {
+		return true
+	}
+
+	for _, proto := range nextProtos {
+		if proto == http2.NextProtoTLS {
+			return true
+		}
+	}
+
+	return false
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+
+	return d
+}
+
+// Record the phase of the request by httptrace,
+// so the timeout error can tell where the request was when the time is up.
+type phaseTracer struct {
+	mu    sync.Mutex
+	phase string
+}
+
+func (t *phaseTracer) set(phase string) {
+	t.mu.Lock()
+	t.phase = phase
+	t.mu.Unlock()
+}
+
+func (t *phaseTracer) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.phase
+}
+
+func (t *phaseTracer) WithContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:              func(string) { t.set(ierror.TimeoutPhaseDial) },
+		TLSHandshakeStart:    func() { t.set(ierror.TimeoutPhaseTlsHandshake) },
+		GotConn:              func(httptrace.GotConnInfo) { t.set(ierror.TimeoutPhaseWriteRequest) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.set(ierror.TimeoutPhaseResponseHeader) },
+		GotFirstResponseByte: func() { t.set(ierror.TimeoutPhaseResponseBody) },
+	})
+}
+
+// Wrap the timeout error to *error.TimeoutError, other errors are returned as is.
+func (t *phaseTracer) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(net.Error); !(ok && e.Timeout()) && err != context.DeadlineExceeded {
+		return err
+	}
+
+	phase := t.get()
+	if phase == "" {
+		phase = ierror.TimeoutPhaseDial
+	}
+
+	return &ierror.TimeoutError{Phase: phase, Err: err}
+}
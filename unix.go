@@ -0,0 +1,84 @@
+package isuperagent
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DialContextFunc creates the connection of the request, see http.Transport.DialContext
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// The url scheme to send request over unix domain socket,
+// the host is the escaped socket path, such as: http+unix://%2Fvar%2Frun%2Fdocker.sock/v1.40/info
+const HttpUnixScheme = "http+unix"
+
+type unixSocketKey struct{}
+
+// Parse the url with http+unix scheme, returns the socket path and the http url.
+// The host of http url is localhost, it is used as the Host header.
+func parseHttpUnixUrl(raw string) (string, string, error) {
+	rest := raw[len(HttpUnixScheme+"://"):]
+
+	i := strings.IndexAny(rest, "/?#")
+	if i < 0 {
+		i = len(rest)
+	}
+
+	socket, err := url.PathUnescape(rest[:i])
+	if err != nil {
+		return "", "", err
+	}
+
+	return socket, "http://localhost" + rest[i:], nil
+}
+
+func isHttpUnixUrl(raw string) bool {
+	return len(raw) > len(HttpUnixScheme+"://") && strings.EqualFold(raw[:len(HttpUnixScheme+"://")], HttpUnixScheme+"://")
+}
+
+// Get the socket path, the socket can be a path or an url with unix scheme, such as unix:///var/run/docker.sock
+func unixSocketPath(socket string) string {
+	if strings.HasPrefix(socket, "unix://") {
+		return strings.TrimPrefix(socket, "unix://")
+	}
+
+	return socket
+}
+
+// Send the request to the unix socket.
+// The host of url is replaced by an unique name of the socket, so the connections of different sockets never mixed up,
+// The original host is still used as the Host header.
+// Only http is supported, the https request is rejected instead of being sent without TLS.
+func withUnixSocket(req *http.Request, socket string) (*http.Request, error) {
+	socket = unixSocketPath(socket)
+
+	if req.URL.Scheme != "http" {
+		return nil, errors.New(fmt.Sprintf("unix socket %s only supports http, but got %s", socket, req.URL.Scheme))
+	}
+	req.URL.Host = fmt.Sprintf("unix-%x", sha1.Sum([]byte(socket)))
+
+	return req.WithContext(context.WithValue(req.Context(), unixSocketKey{}, socket)), nil
+}
+
+func getUnixSocket(ctx context.Context) string {
+	socket, _ := ctx.Value(unixSocketKey{}).(string)
+
+	return socket
+}
+
+// Dial the unix socket if the request is sent to a unix socket, otherwise dial the address.
+func dialUnixSocket(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket := getUnixSocket(ctx); socket != "" {
+			return dial(ctx, "unix", socket)
+		}
+
+		return dial(ctx, network, addr)
+	}
+}
@@ -21,3 +21,24 @@ func (u *URL) String() string {
 
 	return u.URL.String()
 }
+
+// Copy the url and queries.
+func (u *URL) clone() *URL {
+	n := &URL{Queries: url.Values{}}
+	if u.URL != nil {
+		copied := *u.URL
+		if u.User != nil {
+			user := *u.User
+			copied.User = &user
+		}
+		n.URL = &copied
+	} else {
+		n.URL = &url.URL{}
+	}
+
+	for k, vs := range u.Queries {
+		n.Queries[k] = append([]string(nil), vs...)
+	}
+
+	return n
+}